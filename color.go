@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// ColorMode selects the PNG color type written by WritePngWithOptions.
+type ColorMode int
+
+const (
+	// ColorAuto writes a palette image when all frames fit in one palette of
+	// at most 256 colors, and truecolor otherwise. Gray palettes are written
+	// as grayscale.
+	ColorAuto ColorMode = iota
+	// ColorPalette writes color type 3.
+	ColorPalette
+	// ColorRGB writes color type 2. The image must not have transparent pixels.
+	ColorRGB
+	// ColorRGBA writes color type 6.
+	ColorRGBA
+)
+
+var colorModeNames = []string{"auto", "palette", "rgb", "rgba"}
+
+func (v ColorMode) String() string {
+	if int(v) < len(colorModeNames) {
+		return colorModeNames[v]
+	}
+	return fmt.Sprintf("ColorMode(%d)", int(v))
+}
+
+// Set parses the name of a mode, so that ColorMode can be used as a flag.Value.
+func (v *ColorMode) Set(s string) error {
+	for i, name := range colorModeNames {
+		if s == name {
+			*v = ColorMode(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown color mode: %s", s)
+}
+
+// pngFormat is the pixel layout written to IHDR and the image data,
+// and how the image data is filtered and compressed.
+// For grayscale output of palette frames, gray maps the indices to samples
+// and transparencyIndex is written as tRNS or alpha.
+type pngFormat struct {
+	colorType         byte
+	bitDepth          byte
+	gray              []byte
+	transparencyIndex int
+	filter            FilterStrategy
+	level             CompressionLevel
+}
+
+func (v pngFormat) hasAlpha() bool {
+	return v.colorType&alphaUsed != 0
+}
+
+// bytesPerPixel returns the distance to the corresponding byte of the
+// previous pixel used by the filters, which is 1 for packed samples.
+func (v pngFormat) bytesPerPixel() int {
+	channels := 1
+	switch v.colorType {
+	case trueColorUsed:
+		channels = 3
+	case alphaUsed:
+		channels = 2
+	case trueColorUsed | alphaUsed:
+		channels = 4
+	}
+	return max(channels*int(v.bitDepth)/8, 1)
+}
+
+// minPaletteDepth returns the smallest bit depth which can index n colors.
+func minPaletteDepth(n int) int {
+	for _, depth := range []int{1, 2, 4} {
+		if n <= 1<<depth {
+			return depth
+		}
+	}
+	return 8
+}
+
+// setPaletteDepth sets the bit depth of palette output. Zero keeps 8.
+func (v *pngFormat) setPaletteDepth(data *ImageData, depth int) error {
+	if depth == 0 || v.colorType != paletteUsed|trueColorUsed {
+		return nil
+	}
+	switch depth {
+	case 1, 2, 4, 8:
+	default:
+		return &UnsupportedError{Feature: fmt.Sprintf("palette bit depth %d", depth)}
+	}
+	if len(data.palette) > 1<<depth {
+		return &UnsupportedError{Feature: fmt.Sprintf("%d colors at palette bit depth %d", len(data.palette), depth)}
+	}
+	v.bitDepth = byte(depth)
+	return nil
+}
+
+// samePalette reports whether every frame uses the global palette.
+func samePalette(data *ImageData) bool {
+	for _, f := range data.frames {
+		if f.palette == nil {
+			continue
+		}
+		if len(f.palette) != len(data.palette) {
+			return false
+		}
+		for i := range f.palette {
+			if f.palette[i] != data.palette[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// sameTransparency reports whether one tRNS chunk serves all frames: every frame
+// uses the global transparency index, or has none and does not draw that index.
+func sameTransparency(data *ImageData) bool {
+	for _, f := range data.frames {
+		if f.transparencyIndex == data.transparencyIndex {
+			continue
+		}
+		if f.transparencyIndex != -1 || bytes.IndexByte(f.data, byte(data.transparencyIndex)) != -1 {
+			return false
+		}
+	}
+	return true
+}
+
+// indicesInPalette reports whether every opaque pixel and the transparency index
+// have an entry in the global palette, as PLTE and tRNS require.
+func indicesInPalette(data *ImageData) bool {
+	if data.transparencyIndex >= len(data.palette) {
+		return false
+	}
+	for _, f := range data.frames {
+		for _, c := range f.data {
+			if int(c) >= len(data.palette) && int(c) != f.transparencyIndex {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// toTruecolor converts palette frames to RGBA frames.
+// Transparent pixels become transparent black.
+func toTruecolor(data *ImageData) *ImageData {
+	if data.truecolor {
+		return data
+	}
+	t := *data
+	t.truecolor = true
+	t.palette = nil
+	t.transparencyIndex = -1
+	t.frames = make([]ImageFrame, len(data.frames))
+	for i, f := range data.frames {
+		p := f.palette
+		if p == nil {
+			p = data.palette
+		}
+		rgba := make([]byte, len(f.data)*4)
+		for j, c := range f.data {
+			if int(c) == f.transparencyIndex {
+				continue
+			}
+			if int(c) < len(p) {
+				rgba[j*4] = p[c].r
+				rgba[j*4+1] = p[c].g
+				rgba[j*4+2] = p[c].b
+			}
+			rgba[j*4+3] = 255
+		}
+		t.frames[i] = f
+		t.frames[i].palette = nil
+		t.frames[i].transparencyIndex = -1
+		t.frames[i].data = rgba
+	}
+	return &t
+}
+
+// toPalette converts RGBA frames to palette frames with one global palette.
+// It fails if there are more than 256 colors or translucent pixels.
+func toPalette(data *ImageData) (*ImageData, bool) {
+	if !data.truecolor {
+		return data, true
+	}
+	t := *data
+	t.truecolor = false
+	t.palette = nil
+	t.transparencyIndex = -1
+	t.frames = make([]ImageFrame, len(data.frames))
+
+	// The canvas is cleared to transparent, which needs an index even if no
+	// frame pixel is transparent.
+	if showsTransparency(data) {
+		t.transparencyIndex = 0
+	}
+	index := make(map[[3]byte]int)
+	for _, f := range data.frames {
+		for j := 0; j < len(f.data); j += 4 {
+			switch f.data[j+3] {
+			case 0:
+				t.transparencyIndex = 0
+			case 255:
+				c := [3]byte{f.data[j], f.data[j+1], f.data[j+2]}
+				if _, ok := index[c]; !ok {
+					index[c] = len(index)
+				}
+			default:
+				return nil, false
+			}
+		}
+	}
+	first := t.transparencyIndex + 1
+	if first+len(index) > 256 {
+		return nil, false
+	}
+	t.palette = make(Palette, first+len(index))
+	for c, i := range index {
+		t.palette[first+i] = Rgb{c[0], c[1], c[2]}
+	}
+
+	for i, f := range data.frames {
+		d := make([]byte, len(f.data)/4)
+		for j := range d {
+			p := f.data[j*4 : j*4+4]
+			if p[3] == 0 {
+				d[j] = byte(t.transparencyIndex)
+			} else {
+				d[j] = byte(first + index[[3]byte{p[0], p[1], p[2]}])
+			}
+		}
+		t.frames[i] = f
+		t.frames[i].transparencyIndex = t.transparencyIndex
+		t.frames[i].data = d
+	}
+	return &t, true
+}
+
+func opaque(frames []ImageFrame) bool {
+	for _, f := range frames {
+		for j := 3; j < len(f.data); j += 4 {
+			if f.data[j] != 255 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// needsClearIndex reports whether palette data without a transparency index
+// shows the canvas, which APNG clears to transparent black.
+func needsClearIndex(data *ImageData) bool {
+	return data.transparencyIndex == -1 && showsTransparency(data)
+}
+
+// prepareColors converts data to the frame layout mode needs and returns the PNG format for it.
+func prepareColors(data *ImageData, mode ColorMode) (*ImageData, pngFormat, error) {
+	if !data.truecolor && samePalette(data) && sameTransparency(data) && indicesInPalette(data) &&
+		(mode == ColorAuto || mode == ColorPalette) && !needsClearIndex(data) {
+		return data, paletteFormat(data, mode), nil
+	}
+
+	t := toTruecolor(data)
+	switch mode {
+	case ColorAuto, ColorPalette:
+		if p, ok := toPalette(t); ok {
+			return p, paletteFormat(p, mode), nil
+		}
+		if mode == ColorPalette {
+			return nil, pngFormat{}, &UnsupportedError{Feature: "palette output of more than 256 colors or translucent pixels"}
+		}
+		if !showsTransparency(t) {
+			return t, pngFormat{colorType: trueColorUsed, bitDepth: 8}, nil
+		}
+	case ColorRGB:
+		if showsTransparency(t) {
+			return nil, pngFormat{}, &UnsupportedError{Feature: "RGB output of an image with transparent pixels"}
+		}
+		return t, pngFormat{colorType: trueColorUsed, bitDepth: 8}, nil
+	}
+	return t, pngFormat{colorType: trueColorUsed | alphaUsed, bitDepth: 8}, nil
+}
+
+// paletteFormat returns the format for palette frames, which is grayscale
+// in auto mode if all colors are gray.
+func paletteFormat(data *ImageData, mode ColorMode) pngFormat {
+	if mode == ColorAuto {
+		if f, ok := grayFormat(data); ok {
+			return f
+		}
+	}
+	return pngFormat{colorType: paletteUsed | trueColorUsed, bitDepth: 8}
+}
+
+// appendPixel appends a frame pixel as it is laid out in the PNG image data.
+func (v pngFormat) appendPixel(b []byte, p []byte) []byte {
+	if v.colorType == trueColorUsed {
+		return append(b, p[:3]...)
+	}
+	return append(b, p...)
+}
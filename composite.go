@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"slices"
+)
+
+const (
+	disposalUnspecified = iota
+	disposalNone
+	disposalBackground
+	disposalPrevious
+)
+
+// pixelSize returns the bytes per pixel of the frame data:
+// 1 for palette indices, 4 for RGBA.
+func (v *ImageData) pixelSize() int {
+	if v.truecolor {
+		return 4
+	}
+	return 1
+}
+
+// clearPixel returns the pixel the canvas is cleared to.
+func (v *ImageData) clearPixel() []byte {
+	switch {
+	case v.truecolor:
+		return []byte{0, 0, 0, 0}
+	case v.transparencyIndex != -1:
+		return []byte{byte(v.transparencyIndex)}
+	}
+	return []byte{byte(v.backgroundIndex)}
+}
+
+func isTransparent(frame *ImageFrame, p []byte) bool {
+	if len(p) == 4 {
+		return p[3] == 0
+	}
+	return int(p[0]) == frame.transparencyIndex
+}
+
+func drawFrame(canvas []byte, width, height int, frame *ImageFrame, ps int) {
+	for y := 0; y < frame.height; y++ {
+		cy := y + frame.yOffset
+		if cy >= height {
+			break
+		}
+		for x := 0; x < frame.width; x++ {
+			cx := x + frame.xOffset
+			if cx >= width {
+				break
+			}
+			p := frame.data[(y*frame.width+x)*ps : (y*frame.width+x+1)*ps]
+			if !frame.source && isTransparent(frame, p) {
+				continue
+			}
+			copy(canvas[(cy*width+cx)*ps:], p)
+		}
+	}
+}
+
+func fillRect(canvas []byte, width, height int, frame *ImageFrame, p []byte) {
+	ps := len(p)
+	for y := frame.yOffset; y < frame.yOffset+frame.height && y < height; y++ {
+		for x := frame.xOffset; x < frame.xOffset+frame.width && x < width; x++ {
+			copy(canvas[(y*width+x)*ps:], p)
+		}
+	}
+}
+
+// coversCanvas reports whether the first frame covers the logical screen.
+func coversCanvas(data *ImageData) bool {
+	f := &data.frames[0]
+	return f.xOffset == 0 && f.yOffset == 0 && f.width == data.width && f.height == data.height
+}
+
+// insideCanvas reports whether every frame is a non-empty rectangle within the
+// logical screen, which APNG requires and GIF does not.
+func insideCanvas(data *ImageData) bool {
+	for _, f := range data.frames {
+		if f.width == 0 || f.height == 0 || f.xOffset+f.width > data.width || f.yOffset+f.height > data.height {
+			return false
+		}
+	}
+	return true
+}
+
+// showsTransparency reports whether a composited frame has a pixel which is not
+// opaque, like !opaque(compositeFrames(toTruecolor(data))), but keeps a single
+// canvas of opacity flags instead of every frame.
+func showsTransparency(data *ImageData) bool {
+	ps := data.pixelSize()
+	canvas := make([]bool, data.width*data.height)
+	for i := range data.frames {
+		f := &data.frames[i]
+		var saved []bool
+		if f.disposal == disposalPrevious {
+			saved = slices.Clone(canvas)
+		}
+		for y := 0; y < f.height && y+f.yOffset < data.height; y++ {
+			for x := 0; x < f.width && x+f.xOffset < data.width; x++ {
+				p := f.data[(y*f.width+x)*ps : (y*f.width+x+1)*ps]
+				transparent, opaque := int(p[0]) == f.transparencyIndex, true
+				if ps == 4 {
+					transparent, opaque = p[3] == 0, p[3] == 255
+				}
+				if transparent && !f.source {
+					continue
+				}
+				canvas[(y+f.yOffset)*data.width+x+f.xOffset] = opaque && !transparent
+			}
+		}
+		if slices.Contains(canvas, false) {
+			return true
+		}
+
+		switch f.disposal {
+		case disposalBackground:
+			for y := f.yOffset; y < f.yOffset+f.height && y < data.height; y++ {
+				for x := f.xOffset; x < f.xOffset+f.width && x < data.width; x++ {
+					canvas[y*data.width+x] = false
+				}
+			}
+		case disposalPrevious:
+			canvas = saved
+		}
+	}
+	return false
+}
+
+// compositeFrames renders every frame onto the logical screen as GIF viewers do,
+// applying the disposal methods, and returns full screen frames.
+// They are disposed to background, so that each one replaces its predecessor.
+func compositeFrames(data *ImageData) []ImageFrame {
+	ps := data.pixelSize()
+	clear := data.clearPixel()
+	canvas := make([]byte, data.width*data.height*ps)
+	fillRect(canvas, data.width, data.height, &ImageFrame{width: data.width, height: data.height}, clear)
+
+	frames := make([]ImageFrame, len(data.frames))
+	for i := range data.frames {
+		f := &data.frames[i]
+		var saved []byte
+		if f.disposal == disposalPrevious {
+			saved = append([]byte(nil), canvas...)
+		}
+		drawFrame(canvas, data.width, data.height, f, ps)
+
+		frames[i] = ImageFrame{
+			width:             data.width,
+			height:            data.height,
+			delay:             f.delay,
+			disposal:          disposalBackground,
+			transparencyIndex: data.transparencyIndex,
+			data:              append([]byte(nil), canvas...),
+		}
+
+		switch f.disposal {
+		case disposalBackground:
+			fillRect(canvas, data.width, data.height, f, clear)
+		case disposalPrevious:
+			canvas = saved
+		}
+	}
+	return frames
+}
+
+// mergeDuplicateFrames drops composited frames which look the same as their
+// predecessor and adds their delay to it.
+func mergeDuplicateFrames(frames []ImageFrame) []ImageFrame {
+	merged := []ImageFrame{frames[0]}
+	for _, f := range frames[1:] {
+		last := &merged[len(merged)-1]
+		if bytes.Equal(last.data, f.data) && last.delay+f.delay <= math.MaxUint16 {
+			last.delay += f.delay
+			continue
+		}
+		merged = append(merged, f)
+	}
+	return merged
+}
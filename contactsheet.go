@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+const (
+	glyphWidth  = 3
+	glyphHeight = 5
+
+	contactMargin     = 8
+	contactBackground = 224
+)
+
+// digitFont holds 3x5 pixel glyphs of the digits, one row per byte with the
+// leftmost pixel in bit 2.
+var digitFont = [10][glyphHeight]byte{
+	{7, 5, 5, 5, 7},
+	{2, 6, 2, 2, 7},
+	{7, 1, 7, 4, 7},
+	{7, 1, 7, 1, 7},
+	{5, 5, 7, 1, 1},
+	{7, 4, 7, 1, 7},
+	{7, 4, 7, 5, 7},
+	{7, 1, 1, 1, 1},
+	{7, 5, 7, 5, 7},
+	{7, 5, 7, 1, 7},
+}
+
+// ContactOptions configures WriteContactSheet.
+type ContactOptions struct {
+	// Every selects every Nth frame, starting with the first one. Zero selects all.
+	Every int
+
+	// Columns is the number of thumbnails per row. Zero makes the sheet about square.
+	Columns int
+
+	// ThumbWidth and ThumbHeight bound the thumbnail size. Frames are scaled down
+	// to fit, keeping their aspect ratio, but not scaled up. Zero means 160.
+	ThumbWidth  int
+	ThumbHeight int
+}
+
+// numberWidth returns the width of the label of n drawn at scale.
+func numberWidth(n, scale int) int {
+	return len(strconv.Itoa(n))*(glyphWidth+1)*scale - scale
+}
+
+// drawNumber draws n in black onto RGBA pixels with its top left corner at x, y,
+// scaling every font pixel to a square of scale pixels.
+func drawNumber(pixels []byte, width, x, y, scale, n int) {
+	for _, c := range strconv.Itoa(n) {
+		glyph := &digitFont[c-'0']
+		for gy := 0; gy < glyphHeight*scale; gy++ {
+			for gx := 0; gx < glyphWidth*scale; gx++ {
+				if glyph[gy/scale]>>(glyphWidth-1-gx/scale)&1 == 0 {
+					continue
+				}
+				p := ((y+gy)*width + x + gx) * 4
+				copy(pixels[p:p+3], []byte{0, 0, 0})
+			}
+		}
+		x += (glyphWidth + 1) * scale
+	}
+}
+
+// thumbnailSize returns the size of a width×height frame scaled down to fit into
+// maxWidth×maxHeight.
+func thumbnailSize(width, height, maxWidth, maxHeight int) (int, int) {
+	scale := math.Min(1, math.Min(float64(maxWidth)/float64(width), float64(maxHeight)/float64(height)))
+	return max(1, int(math.Round(float64(width)*scale))), max(1, int(math.Round(float64(height)*scale)))
+}
+
+// resizeRGBA scales an RGBA frame to w×h, averaging the pixels of every source
+// area weighted by their alpha.
+func resizeRGBA(f *ImageFrame, w, h int) []byte {
+	pixels := make([]byte, 0, w*h*4)
+	for ty := 0; ty < h; ty++ {
+		sy0 := ty * f.height / h
+		sy1 := max(sy0+1, (ty+1)*f.height/h)
+		for tx := 0; tx < w; tx++ {
+			sx0 := tx * f.width / w
+			sx1 := max(sx0+1, (tx+1)*f.width/w)
+			var sum [3]int
+			alpha := 0
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					p := f.data[(sy*f.width+sx)*4:]
+					for c := range sum {
+						sum[c] += int(p[c]) * int(p[3])
+					}
+					alpha += int(p[3])
+				}
+			}
+			n := (sy1 - sy0) * (sx1 - sx0)
+			if alpha == 0 {
+				pixels = append(pixels, 0, 0, 0, 0)
+				continue
+			}
+			pixels = append(pixels,
+				byte((sum[0]+alpha/2)/alpha),
+				byte((sum[1]+alpha/2)/alpha),
+				byte((sum[2]+alpha/2)/alpha),
+				byte((alpha+n/2)/n))
+		}
+	}
+	return pixels
+}
+
+// drawThumbnail scales an RGBA frame to w×h and draws it blended onto white at
+// x, y of RGBA pixels.
+func drawThumbnail(pixels []byte, width, x, y, w, h int, f *ImageFrame) {
+	thumb := resizeRGBA(f, w, h)
+	for ty := 0; ty < h; ty++ {
+		for tx := 0; tx < w; tx++ {
+			src := thumb[(ty*w+tx)*4:]
+			a := int(src[3])
+			dst := pixels[((y+ty)*width+x+tx)*4:]
+			for c := 0; c < 3; c++ {
+				dst[c] = byte((int(src[c])*a + 255*(255-a) + 127) / 255)
+			}
+		}
+	}
+}
+
+// contactSheet lays out thumbnails of the selected composited frames in a grid,
+// each labeled with its frame number below, and returns the opaque RGBA image.
+func contactSheet(data *ImageData, contact *ContactOptions) (*ImageData, error) {
+	if contact.Every < 0 || contact.Columns < 0 || contact.ThumbWidth < 0 || contact.ThumbHeight < 0 {
+		return nil, fmt.Errorf("Contact sheet options must not be negative: %+v", *contact)
+	}
+	every := max(contact.Every, 1)
+	maxWidth, maxHeight := contact.ThumbWidth, contact.ThumbHeight
+	if maxWidth == 0 {
+		maxWidth = 160
+	}
+	if maxHeight == 0 {
+		maxHeight = 160
+	}
+
+	composited := compositeFrames(toTruecolor(data))
+	var numbers []int
+	for i := 0; i < len(composited); i += every {
+		numbers = append(numbers, i)
+	}
+	columns := contact.Columns
+	if columns == 0 {
+		columns = int(math.Ceil(math.Sqrt(float64(len(numbers)))))
+	}
+	columns = min(columns, len(numbers))
+	rows := (len(numbers) + columns - 1) / columns
+
+	w, h := thumbnailSize(data.width, data.height, maxWidth, maxHeight)
+	scale := 1 + w/128
+	cellWidth := max(w, numberWidth(numbers[len(numbers)-1], scale))
+	cellHeight := h + contactMargin/2 + glyphHeight*scale
+	width := columns*(cellWidth+contactMargin) + contactMargin
+	height := rows*(cellHeight+contactMargin) + contactMargin
+
+	pixels := make([]byte, width*height*4)
+	for i := range pixels {
+		pixels[i] = contactBackground
+		if i%4 == 3 {
+			pixels[i] = 255
+		}
+	}
+	for i, n := range numbers {
+		x := contactMargin + i%columns*(cellWidth+contactMargin)
+		y := contactMargin + i/columns*(cellHeight+contactMargin)
+		drawThumbnail(pixels, width, x+(cellWidth-w)/2, y, w, h, &composited[n])
+		drawNumber(pixels, width, x+(cellWidth-numberWidth(n, scale))/2, y+h+contactMargin/2, scale, n)
+	}
+
+	return &ImageData{
+		width:             width,
+		height:            height,
+		transparencyIndex: -1,
+		truecolor:         true,
+		frames: []ImageFrame{{
+			width:             width,
+			height:            height,
+			transparencyIndex: -1,
+			data:              pixels,
+		}},
+	}, nil
+}
+
+// WriteContactSheet writes a still PNG to w showing thumbnails of the composited
+// frames of data, labeled with their frame numbers, as configured by contact.
+// Of opts, the options of the PNG encoder apply.
+func WriteContactSheet(w io.Writer, data *ImageData, contact *ContactOptions, opts *EncodeOptions) error {
+	if len(data.frames) == 0 {
+		return fmt.Errorf("No frames to write")
+	}
+	if data.width == 0 || data.height == 0 {
+		return &UnsupportedError{Feature: fmt.Sprintf("image size %dx%d", data.width, data.height)}
+	}
+	image, err := contactSheet(data, contact)
+	if err != nil {
+		return err
+	}
+	return WritePngWithOptions(w, image, opts)
+}
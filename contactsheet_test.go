@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestThumbnailSize(t *testing.T) {
+	for _, c := range []struct {
+		width, height, maxWidth, maxHeight int
+		w, h                               int
+	}{
+		{912, 684, 160, 160, 160, 120},
+		{684, 912, 160, 160, 120, 160},
+		{20, 14, 160, 160, 20, 14},
+		{1000, 1, 100, 100, 100, 1},
+	} {
+		w, h := thumbnailSize(c.width, c.height, c.maxWidth, c.maxHeight)
+		if w != c.w || h != c.h {
+			t.Errorf("%dx%d in %dx%d: %dx%d, want %dx%d", c.width, c.height, c.maxWidth, c.maxHeight, w, h, c.w, c.h)
+		}
+	}
+}
+
+func TestDrawThumbnail(t *testing.T) {
+	// Each thumbnail pixel averages 2x2 pixels: half transparent red, and black
+	// and white.
+	f := &ImageFrame{width: 4, height: 2, data: []byte{
+		255, 0, 0, 255, 255, 0, 0, 255, 0, 0, 0, 255, 255, 255, 255, 255,
+		9, 9, 9, 0, 9, 9, 9, 0, 0, 0, 0, 255, 255, 255, 255, 255,
+	}}
+	want := []byte{255, 0, 0, 128, 128, 128, 128, 255}
+	if got := resizeRGBA(f, 2, 1); !bytes.Equal(got, want) {
+		t.Errorf("resized to %v, want %v", got, want)
+	}
+
+	pixels := make([]byte, 3*1*4)
+	drawThumbnail(pixels, 3, 1, 0, 2, 1, f)
+	want = []byte{0, 0, 0, 0, 255, 127, 127, 0, 128, 128, 128, 0}
+	if !bytes.Equal(pixels, want) {
+		t.Errorf("drawn as %v, want %v", pixels, want)
+	}
+}
+
+func TestContactSheet(t *testing.T) {
+	for _, c := range corpus {
+		t.Run(c.name, func(t *testing.T) {
+			data, err := ReadGif(bytes.NewReader(c.gif()), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			contact := &ContactOptions{Every: 2, Columns: 3, ThumbWidth: 8, ThumbHeight: 8}
+			var out bytes.Buffer
+			if err := WriteContactSheet(&out, data, contact, nil); err != nil {
+				t.Fatal(err)
+			}
+			image, err := ReadPng(&out)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			thumbs := (len(data.frames) + 1) / 2
+			columns := min(3, thumbs)
+			rows := (thumbs + columns - 1) / columns
+			w, h := thumbnailSize(data.width, data.height, 8, 8)
+			cellWidth := max(w, numberWidth((thumbs-1)*2, 1))
+			cellHeight := h + contactMargin/2 + glyphHeight
+			if image.width != columns*(cellWidth+contactMargin)+contactMargin || image.height != rows*(cellHeight+contactMargin)+contactMargin {
+				t.Errorf("size %dx%d for %d thumbnails of %dx%d", image.width, image.height, thumbs, w, h)
+			}
+			if !opaque(compositeFrames(toTruecolor(image))) {
+				t.Error("contact sheet is not opaque")
+			}
+		})
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"compress/lzw"
+	"encoding/binary"
+)
+
+// gifBuilder writes GIF streams block by block, independently of WriteGif,
+// so that the corpus can contain what the encoder never produces.
+type gifBuilder struct {
+	bytes.Buffer
+}
+
+func (b *gifBuilder) header(version string) {
+	b.WriteString("GIF" + version)
+}
+
+func (b *gifBuilder) u16(v int) {
+	binary.Write(b, binary.LittleEndian, uint16(v))
+}
+
+// tableFlags returns the size bits of a color table, which has to hold a power of 2 colors.
+func tableFlags(table []byte) byte {
+	size := byte(0)
+	for 3<<(size+1) < len(table) {
+		size++
+	}
+	return size
+}
+
+func (b *gifBuilder) screen(width, height int, table []byte, background byte) {
+	b.u16(width)
+	b.u16(height)
+	flags := byte(7 << 4)
+	if table != nil {
+		flags |= 0x80 | tableFlags(table)
+	}
+	b.WriteByte(flags)
+	b.WriteByte(background)
+	b.WriteByte(0)
+	b.Write(table)
+}
+
+func (b *gifBuilder) subBlocks(data []byte) {
+	for len(data) > 0 {
+		n := min(len(data), 255)
+		b.WriteByte(byte(n))
+		b.Write(data[:n])
+		data = data[n:]
+	}
+	b.WriteByte(0)
+}
+
+func (b *gifBuilder) extension(label byte, blocks ...[]byte) {
+	b.WriteByte(0x21)
+	b.WriteByte(label)
+	for _, block := range blocks {
+		b.WriteByte(byte(len(block)))
+		b.Write(block)
+	}
+	b.WriteByte(0)
+}
+
+// control writes a graphic control extension. transparent is -1 for none.
+func (b *gifBuilder) control(disposal, delay, transparent int) {
+	data := []byte{byte(disposal << 2), byte(delay), byte(delay >> 8), 0}
+	if transparent != -1 {
+		data[0] |= 1
+		data[3] = byte(transparent)
+	}
+	b.extension(0xF9, data)
+}
+
+func (b *gifBuilder) loop(count int) {
+	b.extension(0xFF, []byte("NETSCAPE2.0"), []byte{1, byte(count), byte(count >> 8)})
+}
+
+// image writes an image descriptor and the LZW compressed pixels, which are
+// given in display order and reordered here if interlaced.
+func (b *gifBuilder) image(x, y, width, height int, table []byte, interlaced bool, litWidth int, pixels []byte) {
+	b.WriteByte(0x2C)
+	b.u16(x)
+	b.u16(y)
+	b.u16(width)
+	b.u16(height)
+	var flags byte
+	if table != nil {
+		flags |= 0x80 | tableFlags(table)
+	}
+	if interlaced {
+		flags |= 0x40
+		var rows []byte
+		for _, pass := range [][2]int{{0, 8}, {4, 8}, {2, 4}, {1, 2}} {
+			for row := pass[0]; row < height; row += pass[1] {
+				rows = append(rows, pixels[row*width:(row+1)*width]...)
+			}
+		}
+		pixels = rows
+	}
+	b.WriteByte(flags)
+	b.Write(table)
+
+	var compressed bytes.Buffer
+	w := lzw.NewWriter(&compressed, lzw.LSB, litWidth)
+	w.Write(pixels)
+	w.Close()
+	b.WriteByte(byte(litWidth))
+	b.subBlocks(compressed.Bytes())
+}
+
+func (b *gifBuilder) trailer() {
+	b.WriteByte(0x3b)
+}
+
+// colorTable returns n distinct colors padded to a power of 2.
+func colorTable(n int, seed int) []byte {
+	size := 2
+	for size < n {
+		size *= 2
+	}
+	table := make([]byte, size*3)
+	for i := 0; i < n; i++ {
+		table[i*3] = byte(i*37 + seed*11)
+		table[i*3+1] = byte(i*91 + seed*53)
+		table[i*3+2] = byte(i*13 + 200 - seed*7)
+	}
+	return table
+}
+
+// pattern returns width x height indices below colors, deterministic for seed.
+func pattern(width, height, colors, seed int) []byte {
+	p := make([]byte, width*height)
+	s := uint32(seed)*2654435761 + 1
+	for i := range p {
+		s = s*1103515245 + 12345
+		if (s>>16)%4 == 0 {
+			p[i] = byte((s >> 8) % uint32(colors))
+		} else {
+			p[i] = byte((i%width/3 + i/width/2 + seed) % colors)
+		}
+	}
+	return p
+}
+
+// fill returns width x height copies of c.
+func fill(width, height int, c byte) []byte {
+	return bytes.Repeat([]byte{c}, width*height)
+}
+
+type corpusCase struct {
+	name string
+	// unknownExtension marks streams image/gif refuses to decode.
+	unknownExtension bool
+	build            func(b *gifBuilder)
+}
+
+var corpus = []corpusCase{
+	{name: "still_global", build: func(b *gifBuilder) {
+		b.header("89a")
+		b.screen(16, 12, colorTable(4, 0), 0)
+		b.image(0, 0, 16, 12, nil, false, 2, pattern(16, 12, 4, 1))
+		b.trailer()
+	}},
+	{name: "still_87a", build: func(b *gifBuilder) {
+		b.header("87a")
+		b.screen(10, 10, colorTable(8, 1), 0)
+		b.image(0, 0, 10, 10, nil, false, 3, pattern(10, 10, 8, 2))
+		b.trailer()
+	}},
+	{name: "interlaced", build: func(b *gifBuilder) {
+		b.header("89a")
+		b.screen(17, 19, colorTable(16, 2), 0)
+		b.image(0, 0, 17, 19, nil, true, 4, pattern(17, 19, 16, 3))
+		b.trailer()
+	}},
+	{name: "interlaced_animation", build: func(b *gifBuilder) {
+		b.header("89a")
+		b.screen(12, 9, colorTable(4, 3), 0)
+		b.loop(0)
+		b.control(1, 10, -1)
+		b.image(0, 0, 12, 9, nil, true, 2, pattern(12, 9, 4, 4))
+		b.control(1, 10, -1)
+		b.image(2, 1, 7, 6, nil, true, 2, pattern(7, 6, 4, 5))
+		b.trailer()
+	}},
+	{name: "local_tables", build: func(b *gifBuilder) {
+		b.header("89a")
+		b.screen(12, 10, nil, 0)
+		b.loop(0)
+		for i := 0; i < 3; i++ {
+			b.control(1, 8, -1)
+			b.image(0, 0, 12, 10, colorTable(8, 10+i), false, 3, pattern(12, 10, 8, i))
+		}
+		b.trailer()
+	}},
+	{name: "mixed_tables", build: func(b *gifBuilder) {
+		b.header("89a")
+		b.screen(12, 10, colorTable(4, 4), 0)
+		b.loop(0)
+		b.control(1, 5, -1)
+		b.image(0, 0, 12, 10, nil, false, 2, pattern(12, 10, 4, 6))
+		b.control(1, 5, -1)
+		b.image(3, 2, 6, 5, colorTable(16, 20), false, 4, pattern(6, 5, 16, 7))
+		b.control(1, 5, -1)
+		b.image(1, 1, 4, 4, nil, false, 2, pattern(4, 4, 4, 8))
+		b.trailer()
+	}},
+	{name: "disposal_unspecified", build: disposalCase(0)},
+	{name: "disposal_none", build: disposalCase(1)},
+	{name: "disposal_background", build: disposalCase(2)},
+	{name: "disposal_previous", build: disposalCase(3)},
+	{name: "disposal_background_opaque", build: func(b *gifBuilder) {
+		// Without transparency the cleared canvas has no palette entry.
+		b.header("89a")
+		b.screen(10, 10, colorTable(4, 5), 1)
+		b.loop(0)
+		b.control(2, 10, -1)
+		b.image(0, 0, 10, 10, nil, false, 2, fill(10, 10, 2))
+		b.control(1, 10, -1)
+		b.image(3, 3, 4, 4, nil, false, 2, fill(4, 4, 3))
+		b.trailer()
+	}},
+	{name: "transparency", build: func(b *gifBuilder) {
+		b.header("89a")
+		b.screen(14, 10, colorTable(8, 6), 0)
+		b.loop(0)
+		b.control(1, 7, 0)
+		b.image(0, 0, 14, 10, nil, false, 3, pattern(14, 10, 8, 9))
+		b.control(1, 7, 5)
+		b.image(2, 2, 8, 6, nil, false, 3, pattern(8, 6, 8, 10))
+		b.control(2, 7, 3)
+		b.image(5, 1, 6, 8, nil, false, 3, pattern(6, 8, 8, 11))
+		b.control(1, 7, 0)
+		b.image(0, 0, 4, 4, nil, false, 3, fill(4, 4, 0))
+		b.trailer()
+	}},
+	{name: "lzw_wide_codes", build: func(b *gifBuilder) {
+		// The minimum code size is larger than the color table needs.
+		b.header("89a")
+		b.screen(9, 7, colorTable(4, 7), 0)
+		b.loop(0)
+		b.control(1, 4, -1)
+		b.image(0, 0, 9, 7, nil, false, 7, pattern(9, 7, 4, 12))
+		b.control(1, 4, -1)
+		b.image(0, 0, 9, 7, nil, false, 8, pattern(9, 7, 2, 13))
+		b.trailer()
+	}},
+	{name: "lzw_full_table", build: func(b *gifBuilder) {
+		// Noise fills the code table, so that the encoder emits clear codes.
+		b.header("89a")
+		b.screen(96, 80, colorTable(256, 8), 0)
+		b.image(0, 0, 96, 80, nil, false, 8, pattern(96, 80, 256, 14))
+		b.trailer()
+	}},
+	{name: "lzw_two_colors", build: func(b *gifBuilder) {
+		b.header("89a")
+		b.screen(20, 3, colorTable(2, 9), 0)
+		b.image(0, 0, 20, 3, nil, false, 2, pattern(20, 3, 2, 15))
+		b.trailer()
+	}},
+	{name: "sub_rectangles", build: func(b *gifBuilder) {
+		b.header("89a")
+		b.screen(20, 16, colorTable(16, 10), 0)
+		b.loop(3)
+		b.control(1, 6, -1)
+		b.image(4, 3, 8, 6, nil, false, 4, pattern(8, 6, 16, 16))
+		b.control(1, 6, -1)
+		b.image(15, 10, 5, 6, nil, false, 4, pattern(5, 6, 16, 17))
+		b.control(0, 6, -1)
+		b.image(0, 0, 1, 1, nil, false, 4, fill(1, 1, 7))
+		b.trailer()
+	}},
+	{name: "extensions", build: func(b *gifBuilder) {
+		b.header("89a")
+		b.screen(8, 8, colorTable(4, 11), 0)
+		b.extension(0xFE, []byte("comment before the loop"))
+		b.loop(0)
+		b.extension(0xFF, []byte("XMP DataXMP"), []byte("<x/>"))
+		b.control(1, 9, -1)
+		b.image(0, 0, 8, 8, nil, false, 2, pattern(8, 8, 4, 18))
+		b.extension(0x01, []byte{0, 0, 0, 0, 8, 0, 8, 0, 8, 8, 1, 0}, []byte("hi"))
+		b.control(1, 9, -1)
+		b.image(2, 2, 4, 4, nil, false, 2, pattern(4, 4, 4, 19))
+		b.extension(0xFE, []byte("comment"), []byte("in two blocks"))
+		b.trailer()
+	}},
+	{name: "unknown_extension", unknownExtension: true, build: func(b *gifBuilder) {
+		b.header("89a")
+		b.screen(8, 8, colorTable(4, 12), 0)
+		b.extension(0x99, []byte("private"), []byte{1, 2, 3})
+		b.image(0, 0, 8, 8, nil, false, 2, pattern(8, 8, 4, 20))
+		b.extension(0x42)
+		b.trailer()
+	}},
+}
+
+// disposalCase returns an animation whose frames all use the disposal method,
+// drawing sub-rectangles with transparent pixels over a full first frame.
+func disposalCase(disposal int) func(b *gifBuilder) {
+	return func(b *gifBuilder) {
+		b.header("89a")
+		b.screen(16, 12, colorTable(8, 13+disposal), 0)
+		b.loop(0)
+		b.control(disposal, 10, 7)
+		b.image(0, 0, 16, 12, nil, false, 3, pattern(16, 12, 7, 21))
+		for i := 0; i < 3; i++ {
+			b.control(disposal, 10+i*5, 7)
+			b.image(2+i*3, 1+i*2, 6, 5, nil, false, 3, pattern(6, 5, 8, 22+i))
+		}
+		b.trailer()
+	}
+}
+
+// corpusCaseNamed returns the corpus case called name, or nil.
+func corpusCaseNamed(name string) *corpusCase {
+	for i := range corpus {
+		if corpus[i].name == name {
+			return &corpus[i]
+		}
+	}
+	return nil
+}
+
+func (c *corpusCase) gif() []byte {
+	var b gifBuilder
+	c.build(&b)
+	return b.Bytes()
+}
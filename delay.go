@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// DelayPolicy decides how GIF frame delays are written to fcTL.
+type DelayPolicy int
+
+const (
+	// DelayPreserve writes the delays as they are.
+	DelayPreserve DelayPolicy = iota
+	// DelayBrowser replaces delays of 0 and 1 centiseconds with 10, as browsers play GIF.
+	DelayBrowser
+	// DelayMinimum raises delays shorter than EncodeOptions.MinDelay to it.
+	DelayMinimum
+)
+
+var delayPolicyNames = []string{"preserve", "browser", "min"}
+
+func (v DelayPolicy) String() string {
+	if int(v) < len(delayPolicyNames) {
+		return delayPolicyNames[v]
+	}
+	return fmt.Sprintf("DelayPolicy(%d)", int(v))
+}
+
+// Set parses the name of a policy, so that DelayPolicy can be used as a flag.Value.
+func (v *DelayPolicy) Set(s string) error {
+	for i, name := range delayPolicyNames {
+		if s == name {
+			*v = DelayPolicy(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown delay policy: %s", s)
+}
+
+// frameDelay converts a delay in centiseconds to the fcTL delay fraction.
+// The browser policy applies to the GIF delay, the speed and then the minimum
+// delay to what is played.
+func (v *EncodeOptions) frameDelay(delay int) (num uint16, den uint16) {
+	if v.DelayPolicy == DelayBrowser && delay <= 1 {
+		delay = 10
+	}
+	d := float64(delay)
+	if v.Speed > 0 {
+		d /= v.Speed
+	}
+	if v.DelayPolicy == DelayMinimum && d < float64(v.MinDelay) {
+		d = float64(v.MinDelay)
+	}
+	if d == math.Trunc(d) && d <= math.MaxUint16 {
+		return uint16(d), 100
+	}
+	for _, den := range []uint16{1000, 100, 10, 1} {
+		n := math.Round(d * float64(den) / 100)
+		if n <= math.MaxUint16 {
+			return uint16(n), den
+		}
+	}
+	return math.MaxUint16, 1
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrorPosition locates a decode error in the input.
+// Frame is the index of the frame being decoded, or the one that would follow.
+type ErrorPosition struct {
+	Offset int64
+	Block  string
+	Frame  int
+}
+
+func (p *ErrorPosition) position() *ErrorPosition {
+	return p
+}
+
+func (p ErrorPosition) String() string {
+	if p.Block == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (%s at offset %d, frame %d)", p.Block, p.Offset, p.Frame)
+}
+
+type positioner interface {
+	position() *ErrorPosition
+}
+
+// FormatError reports that the input is not a valid GIF.
+type FormatError struct {
+	ErrorPosition
+	Msg string
+	Err error
+}
+
+func (e *FormatError) Error() string {
+	return e.Msg + e.ErrorPosition.String()
+}
+
+func (e *FormatError) Unwrap() error {
+	return e.Err
+}
+
+// UnsupportedError reports that the input uses a feature this decoder can not handle.
+type UnsupportedError struct {
+	ErrorPosition
+	Feature string
+}
+
+func (e *UnsupportedError) Error() string {
+	return "Not supported: " + e.Feature + e.ErrorPosition.String()
+}
+
+// TruncatedError reports that the input ended in the middle of a block.
+type TruncatedError struct {
+	ErrorPosition
+}
+
+func (e *TruncatedError) Error() string {
+	return "Unexpected EOF" + e.ErrorPosition.String()
+}
+
+func (e *TruncatedError) Unwrap() error {
+	return io.ErrUnexpectedEOF
+}
+
+// LimitError is returned when the input exceeds one of the DecodeOptions limits.
+type LimitError struct {
+	ErrorPosition
+	Limit  string
+	Max    int64
+	Actual int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("Limit exceeded: %s. max: %d, actual: %d%s", e.Limit, e.Max, e.Actual, e.ErrorPosition.String())
+}
+
+func formatError(format string, a ...interface{}) error {
+	return &FormatError{Msg: fmt.Sprintf(format, a...)}
+}
+
+type countingReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (v *countingReader) Read(p []byte) (n int, err error) {
+	n, err = v.r.Read(p)
+	v.n += int64(n)
+	if err != nil && err != io.EOF {
+		v.err = err
+	}
+	return
+}
+
+// withPosition classifies err and fills in where it happened.
+// Errors of the underlying reader are returned as is.
+func withPosition(err error, r *countingReader, pos ErrorPosition) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return &TruncatedError{ErrorPosition: pos}
+	}
+	if err == r.err {
+		return err
+	}
+	var p positioner
+	if !errors.As(err, &p) {
+		return &FormatError{ErrorPosition: pos, Msg: err.Error(), Err: err}
+	}
+	if p.position().Block == "" {
+		*p.position() = pos
+	}
+	return err
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// twoFrames returns a 4x4 GIF with a 4 color global table and two full frames.
+func twoFrames() []byte {
+	var b gifBuilder
+	b.header("89a")
+	b.screen(4, 4, colorTable(4, 1), 0)
+	b.image(0, 0, 4, 4, nil, false, 2, pattern(4, 4, 4, 0))
+	b.image(0, 0, 4, 4, nil, false, 2, pattern(4, 4, 4, 1))
+	b.trailer()
+	return b.Bytes()
+}
+
+func TestLimits(t *testing.T) {
+	for _, c := range []struct {
+		opts   DecodeOptions
+		limit  string
+		actual int64
+		frame  int
+	}{
+		{DecodeOptions{MaxCanvasPixels: 15}, "MaxCanvasPixels", 16, 0},
+		{DecodeOptions{MaxFrames: 1}, "MaxFrames", 2, 1},
+		{DecodeOptions{MaxLZWOutput: 15}, "MaxLZWOutput", 16, 0},
+		{DecodeOptions{MaxTotalBytes: 40}, "MaxTotalBytes", 12 + 16 + 16, 1},
+	} {
+		_, err := ReadGifWithOptions(bytes.NewReader(twoFrames()), &c.opts)
+		var limit *LimitError
+		if !errors.As(err, &limit) {
+			t.Errorf("%s: got %v, want a LimitError", c.limit, err)
+			continue
+		}
+		if limit.Limit != c.limit || limit.Actual != c.actual || limit.Frame != c.frame {
+			t.Errorf("%s: got %+v", c.limit, limit)
+		}
+	}
+
+	opts := DecodeOptions{MaxCanvasPixels: 16, MaxFrames: 2, MaxLZWOutput: 16, MaxTotalBytes: 44}
+	if _, err := ReadGifWithOptions(bytes.NewReader(twoFrames()), &opts); err != nil {
+		t.Errorf("at the limits: %v", err)
+	}
+}
+
+// TestLimitsBeforeAllocation checks that oversized frames and extensions fail
+// before their data is allocated or read.
+func TestLimitsBeforeAllocation(t *testing.T) {
+	var frame gifBuilder
+	frame.header("89a")
+	frame.screen(1, 1, colorTable(2, 1), 0)
+	frame.WriteByte(0x2C)
+	frame.Write([]byte{0, 0, 0, 0, 0xFF, 0xFF, 0xFF, 0xFF, 0})
+
+	blocks := [][]byte{[]byte("EXAMPLE11.0")}
+	for i := 0; i < 1000; i++ {
+		blocks = append(blocks, make([]byte, 255))
+	}
+	var application, unknown gifBuilder
+	for _, b := range []*gifBuilder{&application, &unknown} {
+		b.header("89a")
+		b.screen(1, 1, colorTable(2, 1), 0)
+	}
+	application.extension(0xFF, blocks...)
+	unknown.extension(0x42, blocks...)
+
+	for _, c := range []struct {
+		name   string
+		stream []byte
+		opts   DecodeOptions
+		limit  string
+		block  string
+		actual int64
+	}{
+		{"frame", frame.Bytes(), DecodeOptions{MaxCanvasPixels: 16}, "MaxCanvasPixels", "Image Descriptor", 0xFFFF * 0xFFFF},
+		{"application", application.Bytes(), DecodeOptions{MaxTotalBytes: 1000}, "MaxTotalBytes", "Application Extension", 6 + 4*255},
+		{"unknown", unknown.Bytes(), DecodeOptions{MaxTotalBytes: 1000, KeepUnknownExtensions: true}, "MaxTotalBytes", "Extension 0x42", 6 + 11 + 4*255},
+	} {
+		_, err := ReadGifWithOptions(bytes.NewReader(c.stream), &c.opts)
+		var limit *LimitError
+		if !errors.As(err, &limit) {
+			t.Errorf("%s: got %v, want a LimitError", c.name, err)
+			continue
+		}
+		if limit.Limit != c.limit || limit.Block != c.block || limit.Actual != c.actual {
+			t.Errorf("%s: got %+v", c.name, limit)
+		}
+	}
+
+	// The LZW limit counts decoded bytes, not the frame size.
+	opts := DecodeOptions{MaxLZWOutput: 8}
+	_, err := ReadGifWithOptions(bytes.NewReader(twoFrames()), &opts)
+	var limit *LimitError
+	if !errors.As(err, &limit) || limit.Limit != "MaxLZWOutput" || limit.Actual != 9 || limit.Block != "Image Data" {
+		t.Errorf("MaxLZWOutput: got %v", err)
+	}
+}
+
+func TestErrorPosition(t *testing.T) {
+	var b gifBuilder
+	b.header("89a")
+	b.screen(4, 4, colorTable(4, 1), 0)
+	b.image(0, 0, 4, 4, nil, false, 2, pattern(4, 4, 4, 0))
+	second := b.Len()
+	b.control(0, 10, -1)
+	control := b.Len()
+	b.image(0, 0, 4, 4, nil, false, 2, pattern(4, 4, 4, 1))
+	trailer := b.Len()
+	b.trailer()
+	stream := b.Bytes()
+
+	corrupt := func(offset int, v byte) []byte {
+		s := bytes.Clone(stream)
+		s[offset] = v
+		return s
+	}
+	type position struct {
+		block  string
+		offset int64
+		frame  int
+	}
+	for _, c := range []struct {
+		name      string
+		input     []byte
+		truncated bool
+		want      position
+	}{
+		{"header", stream[:3], true, position{"Header", 0, 0}},
+		{"screen", stream[:10], true, position{"Logical Screen Descriptor", 6, 0}},
+		{"control", stream[:second+4], true, position{"Graphic Control Extension", int64(second), 1}},
+		{"descriptor", stream[:control+5], true, position{"Image Descriptor", int64(control), 1}},
+		{"image data", stream[:trailer-2], true, position{"Image Data", int64(control + 10), 1}},
+		{"trailer", stream[:trailer], true, position{"Block Introducer", int64(trailer), 2}},
+		{"version", corrupt(5, 'x'), false, position{"Header", 0, 0}},
+		{"unknown code", corrupt(trailer, 0x99), false, position{"Block Introducer", int64(trailer), 2}},
+	} {
+		_, err := ReadGifWithOptions(bytes.NewReader(c.input), nil)
+		var p positioner
+		if c.truncated {
+			var truncated *TruncatedError
+			if !errors.As(err, &truncated) || !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("%s: got %v, want a TruncatedError", c.name, err)
+				continue
+			}
+			p = truncated
+		} else {
+			var format *FormatError
+			if !errors.As(err, &format) {
+				t.Errorf("%s: got %v, want a FormatError", c.name, err)
+				continue
+			}
+			p = format
+		}
+		pos := p.position()
+		if got := (position{pos.Block, pos.Offset, pos.Frame}); got != c.want {
+			t.Errorf("%s: position %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}
+
+// TestTruncatedCorpus checks that every proper prefix of a corpus stream fails
+// with a TruncatedError located at or before the end of the prefix.
+func TestTruncatedCorpus(t *testing.T) {
+	for _, c := range corpus {
+		stream := c.gif()
+		for n := 0; n < len(stream); n++ {
+			_, err := ReadGifWithOptions(bytes.NewReader(stream[:n]), nil)
+			var truncated *TruncatedError
+			if !errors.As(err, &truncated) {
+				t.Errorf("%s cut at %d: got %v, want a TruncatedError", c.name, n, err)
+				break
+			}
+			if truncated.Offset > int64(n) {
+				t.Errorf("%s cut at %d: offset %d", c.name, n, truncated.Offset)
+				break
+			}
+		}
+	}
+}
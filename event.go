@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// DecodeEvent is an event reported to a DecodeObserver while reading a GIF.
+// It is one of *HeaderEvent, *ScreenDescriptorEvent, *GraphicControlEvent,
+// *ImageEvent, *ExtensionEvent and *WarningEvent.
+type DecodeEvent interface {
+	fmt.Stringer
+	decodeEvent()
+}
+
+// DecodeObserver receives the events of ReadGifWithOptions.
+type DecodeObserver interface {
+	OnEvent(event DecodeEvent)
+}
+
+// DecodeObserverFunc adapts a function to DecodeObserver.
+type DecodeObserverFunc func(event DecodeEvent)
+
+// OnEvent calls f(event).
+func (f DecodeObserverFunc) OnEvent(event DecodeEvent) {
+	f(event)
+}
+
+// LogObserver writes every event to Logger, or to the standard logger if Logger is nil.
+type LogObserver struct {
+	Logger *log.Logger
+}
+
+// OnEvent logs the event.
+func (v *LogObserver) OnEvent(event DecodeEvent) {
+	if v.Logger == nil {
+		log.Println(event)
+		return
+	}
+	v.Logger.Println(event)
+}
+
+// HeaderEvent reports the GIF header.
+type HeaderEvent struct {
+	Offset    int64
+	Signature string
+	Version   string
+}
+
+// ScreenDescriptorEvent reports the logical screen descriptor.
+type ScreenDescriptorEvent struct {
+	Offset               int64
+	Width                int
+	Height               int
+	GlobalColorTableSize int
+	BackgroundColorIndex int
+	PixelAspectRatio     int
+}
+
+// GraphicControlEvent reports a graphic control extension.
+// TransparencyIndex is -1 when the transparent color flag is not set.
+type GraphicControlEvent struct {
+	Offset            int64
+	Frame             int
+	DisposalMethod    int
+	UserInput         bool
+	Delay             int
+	TransparencyIndex int
+}
+
+// ImageEvent reports an image descriptor.
+type ImageEvent struct {
+	Offset              int64
+	Frame               int
+	Left                int
+	Top                 int
+	Width               int
+	Height              int
+	Interlaced          bool
+	LocalColorTableSize int
+}
+
+// ExtensionEvent reports an extension other than the graphic control extension.
+// Application is set for application extensions, Skipped when the content was discarded.
+type ExtensionEvent struct {
+	Offset      int64
+	Frame       int
+	Label       byte
+	Application string
+	Skipped     bool
+}
+
+// WarningEvent reports a recoverable problem in the input.
+type WarningEvent struct {
+	Offset  int64
+	Frame   int
+	Message string
+}
+
+func (*HeaderEvent) decodeEvent()           {}
+func (*ScreenDescriptorEvent) decodeEvent() {}
+func (*GraphicControlEvent) decodeEvent()   {}
+func (*ImageEvent) decodeEvent()            {}
+func (*ExtensionEvent) decodeEvent()        {}
+func (*WarningEvent) decodeEvent()          {}
+
+func (v *HeaderEvent) String() string {
+	return fmt.Sprintf("GIF Header: %s%s", v.Signature, v.Version)
+}
+
+func (v *ScreenDescriptorEvent) String() string {
+	return fmt.Sprintf("Logical Screen Descriptor: %dx%d, GlobalColorTableSize: %d, BackgroundColorIndex: %d, PixelAspectRatio: %d",
+		v.Width, v.Height, v.GlobalColorTableSize, v.BackgroundColorIndex, v.PixelAspectRatio)
+}
+
+func (v *GraphicControlEvent) String() string {
+	return fmt.Sprintf("Graphic Control Extension: frame %d, DisposalMethod: %d, UserInput: %v, Delay: %d, TransparencyIndex: %d",
+		v.Frame, v.DisposalMethod, v.UserInput, v.Delay, v.TransparencyIndex)
+}
+
+func (v *ImageEvent) String() string {
+	return fmt.Sprintf("Image Descriptor: frame %d, %dx%d at (%d, %d), Interlaced: %v, LocalColorTableSize: %d",
+		v.Frame, v.Width, v.Height, v.Left, v.Top, v.Interlaced, v.LocalColorTableSize)
+}
+
+func (v *ExtensionEvent) String() string {
+	s := extensionName(v.Label)
+	if v.Application != "" {
+		s += ": " + v.Application
+	}
+	if v.Skipped {
+		s = "Skip " + s
+	}
+	return s
+}
+
+func (v *WarningEvent) String() string {
+	return fmt.Sprintf("Warning: %s (offset %d, frame %d)", v.Message, v.Offset, v.Frame)
+}
+
+func (v *DecodeOptions) notify(event DecodeEvent) {
+	if v != nil && v.Observer != nil {
+		v.Observer.OnEvent(event)
+	}
+}
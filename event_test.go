@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeObserver(t *testing.T) {
+	stream, offsets := inspectStream()
+	var events []DecodeEvent
+	opts := &DecodeOptions{Observer: DecodeObserverFunc(func(event DecodeEvent) {
+		events = append(events, event)
+	})}
+	if _, err := ReadGifWithOptions(bytes.NewReader(stream), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []DecodeEvent{
+		&HeaderEvent{Offset: 0, Signature: "GIF", Version: "89a"},
+		&ScreenDescriptorEvent{Offset: 6, Width: 4, Height: 4, GlobalColorTableSize: 4},
+		&ExtensionEvent{Offset: int64(offsets[0]), Label: 0xFF, Application: "NETSCAPE 2.0"},
+		&GraphicControlEvent{Offset: int64(offsets[1]), DisposalMethod: 2, Delay: 10, TransparencyIndex: 3},
+		&ImageEvent{Offset: int64(offsets[2]), Width: 4, Height: 4},
+		&ExtensionEvent{Offset: int64(offsets[3]), Frame: 1, Label: 0xFE, Skipped: true},
+		&ImageEvent{Offset: int64(offsets[4]), Frame: 1, Left: 1, Top: 1, Width: 2, Height: 2, Interlaced: true, LocalColorTableSize: 2},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("%d events, want %d: %v", len(events), len(want), events)
+	}
+	for i := range want {
+		if !reflect.DeepEqual(events[i], want[i]) {
+			t.Errorf("event %d: %#v, want %#v", i, events[i], want[i])
+		}
+	}
+
+	var b gifBuilder
+	b.header("89a")
+	b.screen(4, 4, colorTable(4, 1), 0)
+	b.extension(0x42, []byte("unknown"))
+	b.image(2, 2, 4, 4, nil, false, 2, pattern(4, 4, 4, 0))
+	b.trailer()
+	events = nil
+	if _, err := ReadGifWithOptions(bytes.NewReader(b.Bytes()), opts); err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := events[2].(*ExtensionEvent); !ok || e.Label != 0x42 || !e.Skipped {
+		t.Errorf("unknown extension: %v", events[2])
+	}
+	if e, ok := events[4].(*WarningEvent); !ok || e.Offset != events[3].(*ImageEvent).Offset {
+		t.Errorf("image outside the screen: %v", events[4])
+	}
+}
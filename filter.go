@@ -0,0 +1,172 @@
+package main
+
+import (
+	"compress/zlib"
+	"fmt"
+)
+
+// FilterStrategy selects the PNG filter type of each scanline.
+type FilterStrategy int
+
+const (
+	// FilterNone does not filter.
+	FilterNone FilterStrategy = iota
+	// FilterSub subtracts the pixel to the left.
+	FilterSub
+	// FilterUp subtracts the pixel above.
+	FilterUp
+	// FilterAverage subtracts the mean of the pixels to the left and above.
+	FilterAverage
+	// FilterPaeth subtracts the Paeth predictor of the neighboring pixels.
+	FilterPaeth
+	// FilterAdaptive chooses the filter with the minimum sum of absolute differences per scanline.
+	FilterAdaptive
+)
+
+var filterStrategyNames = []string{"none", "sub", "up", "average", "paeth", "adaptive"}
+
+func (v FilterStrategy) String() string {
+	if int(v) < len(filterStrategyNames) {
+		return filterStrategyNames[v]
+	}
+	return fmt.Sprintf("FilterStrategy(%d)", int(v))
+}
+
+// Set parses the name of a strategy, so that FilterStrategy can be used as a flag.Value.
+func (v *FilterStrategy) Set(s string) error {
+	for i, name := range filterStrategyNames {
+		if s == name {
+			*v = FilterStrategy(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown filter strategy: %s", s)
+}
+
+// CompressionLevel selects the zlib compression level.
+type CompressionLevel int
+
+const (
+	// BestCompression compresses at zlib level 9.
+	BestCompression CompressionLevel = iota
+	// DefaultCompression uses the zlib default level.
+	DefaultCompression
+	// BestSpeed compresses at zlib level 1.
+	BestSpeed
+	// NoCompression writes stored deflate blocks.
+	NoCompression
+)
+
+var compressionLevelNames = []string{"best", "default", "fast", "none"}
+
+func (v CompressionLevel) String() string {
+	if int(v) < len(compressionLevelNames) {
+		return compressionLevelNames[v]
+	}
+	return fmt.Sprintf("CompressionLevel(%d)", int(v))
+}
+
+// Set parses the name of a level, so that CompressionLevel can be used as a flag.Value.
+func (v *CompressionLevel) Set(s string) error {
+	for i, name := range compressionLevelNames {
+		if s == name {
+			*v = CompressionLevel(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown compression level: %s", s)
+}
+
+func (v CompressionLevel) zlibLevel() int {
+	switch v {
+	case DefaultCompression:
+		return zlib.DefaultCompression
+	case BestSpeed:
+		return zlib.BestSpeed
+	case NoCompression:
+		return zlib.NoCompression
+	}
+	return zlib.BestCompression
+}
+
+func abs(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+// filterRow writes cur filtered by filterType to dst. prev is the unfiltered
+// previous scanline, all zero for the first one.
+func filterRow(dst, cur, prev []byte, bpp int, filterType byte) {
+	for i := range cur {
+		var a, c byte
+		if i >= bpp {
+			a, c = cur[i-bpp], prev[i-bpp]
+		}
+		b := prev[i]
+		switch filterType {
+		case subFilter:
+			dst[i] = cur[i] - a
+		case upFilter:
+			dst[i] = cur[i] - b
+		case averageFilter:
+			dst[i] = cur[i] - byte((int(a)+int(b))/2)
+		case paethFilter:
+			dst[i] = cur[i] - paeth(a, b, c)
+		default:
+			dst[i] = cur[i]
+		}
+	}
+}
+
+func sumAbs(b []byte) int {
+	sum := 0
+	for _, c := range b {
+		sum += abs(int(int8(c)))
+	}
+	return sum
+}
+
+// applyFilter filters the scanlines of b in place. Each scanline is a filter
+// type byte followed by rowLen bytes.
+func applyFilter(b []byte, rowLen int, bpp int, strategy FilterStrategy) {
+	if strategy == FilterNone {
+		return
+	}
+	prev := make([]byte, rowLen)
+	cur := make([]byte, rowLen)
+	best := make([]byte, rowLen)
+	tmp := make([]byte, rowLen)
+	for i := 0; i+rowLen < len(b); i += rowLen + 1 {
+		copy(cur, b[i+1:i+1+rowLen])
+		filterType := byte(strategy)
+		if strategy == FilterAdaptive {
+			bestSum := -1
+			for t := byte(noneFilter); t <= paethFilter; t++ {
+				filterRow(tmp, cur, prev, bpp, t)
+				if s := sumAbs(tmp); bestSum < 0 || s < bestSum {
+					bestSum, filterType = s, t
+					best, tmp = tmp, best
+				}
+			}
+		} else {
+			filterRow(best, cur, prev, bpp, filterType)
+		}
+		b[i] = filterType
+		copy(b[i+1:], best)
+		prev, cur = cur, prev
+	}
+}
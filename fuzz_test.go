@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fuzzLimits keeps the decoder from allocating more than the fuzzer can afford.
+var fuzzLimits = DecodeOptions{
+	MaxCanvasPixels: 1 << 16,
+	MaxFrames:       64,
+	MaxTotalBytes:   1 << 20,
+	MaxLZWOutput:    1 << 16,
+}
+
+// crashers are inputs the fuzzers found to panic or fail once.
+var crashers = []func(b *gifBuilder){
+	func(b *gifBuilder) {
+		// No image before the trailer.
+		b.header("89a")
+		b.screen(1, 1, nil, 0)
+		b.trailer()
+	},
+	func(b *gifBuilder) {
+		// No color table at all.
+		b.header("87a")
+		b.screen(4, 4, nil, 0)
+		b.image(0, 0, 4, 4, nil, false, 2, pattern(4, 4, 4, 1))
+		b.trailer()
+	},
+	func(b *gifBuilder) {
+		// The transparency index is outside the color table.
+		b.header("89a")
+		b.screen(4, 4, colorTable(2, 0), 0)
+		b.control(1, 5, 9)
+		b.image(0, 0, 4, 4, nil, false, 4, pattern(4, 4, 10, 2))
+		b.trailer()
+	},
+	func(b *gifBuilder) {
+		// The first frame draws the color the second one makes transparent.
+		b.header("89a")
+		b.screen(8, 8, colorTable(8, 1), 0)
+		b.loop(0)
+		b.control(1, 5, -1)
+		b.image(2, 2, 4, 4, nil, false, 3, pattern(4, 4, 8, 3))
+		b.control(1, 5, 7)
+		b.image(0, 0, 8, 8, nil, false, 3, pattern(8, 8, 8, 4))
+		b.trailer()
+	},
+	func(b *gifBuilder) {
+		// Frames which are empty or reach beyond the logical screen.
+		b.header("89a")
+		b.screen(8, 8, colorTable(4, 2), 0)
+		b.loop(0)
+		b.image(0, 0, 8, 8, nil, false, 2, pattern(8, 8, 4, 5))
+		b.image(6, 5, 4, 4, nil, false, 2, pattern(4, 4, 4, 6))
+		b.image(0, 0, 3, 0, nil, false, 2, nil)
+		b.trailer()
+	},
+	func(b *gifBuilder) {
+		// A logical screen without rows.
+		b.header("89a")
+		b.screen(12, 0, colorTable(4, 3), 0)
+		b.image(0, 0, 12, 0, nil, false, 2, nil)
+		b.trailer()
+	},
+}
+
+func addCorpus(f *testing.F) {
+	for _, c := range corpus {
+		f.Add(c.gif())
+	}
+	for _, build := range crashers {
+		f.Add((&corpusCase{build: build}).gif())
+	}
+	if b, err := os.ReadFile("test.gif"); err == nil {
+		f.Add(b)
+	}
+}
+
+func FuzzReadGif(f *testing.F) {
+	addCorpus(f)
+	f.Fuzz(func(t *testing.T, b []byte) {
+		opts := fuzzLimits
+		opts.KeepUnknownExtensions = true
+		data, err := ReadGifWithOptions(bytes.NewReader(b), &opts)
+		if err != nil {
+			return
+		}
+		if len(data.frames) == 0 {
+			t.Fatal("no frames without an error")
+		}
+		for i, f := range data.frames {
+			if len(f.data) != f.width*f.height {
+				t.Fatalf("frame %d: %d bytes for %dx%d", i, len(f.data), f.width, f.height)
+			}
+		}
+		if showsTransparency(data) == opaque(compositeFrames(toTruecolor(data))) {
+			t.Fatal("showsTransparency disagrees with the composited frames")
+		}
+	})
+}
+
+func FuzzBlockReader(f *testing.F) {
+	f.Add([]byte{0})
+	f.Add([]byte{3, 1, 2, 3, 1, 4, 0})
+	f.Add([]byte{5, 1, 2})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		got, err := io.ReadAll(newBlockReader(bytes.NewReader(b)))
+
+		var want []byte
+		rest := b
+		for {
+			if len(rest) == 0 {
+				if err != io.ErrUnexpectedEOF {
+					t.Fatalf("missing terminator: %v", err)
+				}
+				return
+			}
+			size := int(rest[0])
+			if size == 0 {
+				break
+			}
+			if len(rest) < size+1 {
+				if err != io.ErrUnexpectedEOF {
+					t.Fatalf("truncated block: %v", err)
+				}
+				return
+			}
+			want = append(want, rest[1:size+1]...)
+			rest = rest[size+1:]
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	})
+}
+
+func FuzzDeinterlace(f *testing.F) {
+	f.Add(uint8(1), uint8(1), []byte{7})
+	f.Add(uint8(3), uint8(9), pattern(3, 9, 16, 1))
+	f.Add(uint8(17), uint8(19), pattern(17, 19, 16, 3))
+	f.Add(uint8(4), uint8(9), pattern(4, 3, 16, 4))
+	f.Fuzz(func(t *testing.T, width, height uint8, b []byte) {
+		w, h := int(width), int(height)
+		frame := &ImageFrame{width: w, height: h, data: b}
+		d := deinterlace(frame, w, h)
+		if len(d) != w*h {
+			t.Fatalf("%d bytes for %dx%d", len(d), w, h)
+		}
+		if len(b) < w*h {
+			return
+		}
+		// Interlacing the rows again gives back the input.
+		var rows []byte
+		for _, pass := range [][2]int{{0, 8}, {4, 8}, {2, 4}, {1, 2}} {
+			for y := pass[0]; y < h; y += pass[1] {
+				rows = append(rows, d[y*w:(y+1)*w]...)
+			}
+		}
+		if !bytes.Equal(rows, b[:w*h]) {
+			t.Fatal("rows are not a permutation of the input")
+		}
+	})
+}
+
+func FuzzWritePng(f *testing.F) {
+	addCorpus(f)
+	f.Fuzz(func(t *testing.T, b []byte) {
+		opts := fuzzLimits
+		data, err := ReadGifWithOptions(bytes.NewReader(b), &opts)
+		if err != nil {
+			return
+		}
+		var out bytes.Buffer
+		if err := WritePng(&out, data); err != nil {
+			return
+		}
+		if err := VerifyPng(&out, toTruecolor(data), nil); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// pngStream returns a PNG with the given IHDR fields and raw image data.
+func pngStream(width, height uint32, depth, colorType byte, raw []byte) []byte {
+	var b bytes.Buffer
+	b.Write(pngSignature)
+	ihdr := binary.BigEndian.AppendUint32(nil, width)
+	ihdr = binary.BigEndian.AppendUint32(ihdr, height)
+	ihdr = append(ihdr, depth, colorType, 0, 0, 0)
+	writeChunk(&b, "IHDR", ihdr)
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	zw.Write(raw)
+	zw.Close()
+	writeChunk(&b, "IDAT", z.Bytes())
+	writeChunk(&b, "IEND", nil)
+	return b.Bytes()
+}
+
+func TestReadPngHugeCanvas(t *testing.T) {
+	_, err := ReadPng(bytes.NewReader(pngStream(1<<31-1, 1<<31-1, 8, 6, []byte{0, 1, 2, 3, 4})))
+	var limit *LimitError
+	if !errors.As(err, &limit) {
+		t.Errorf("huge canvas: got %v, want a LimitError", err)
+	}
+	// Within the default limit, but with far too little image data.
+	_, err = ReadPng(bytes.NewReader(pngStream(1<<14, 1<<14, 8, 6, []byte{0, 1, 2, 3, 4})))
+	var format *FormatError
+	if !errors.As(err, &format) {
+		t.Errorf("short image data: got %v, want a FormatError", err)
+	}
+}
+
+func FuzzReadPng(f *testing.F) {
+	goldens, _ := filepath.Glob("testdata/golden/*.png")
+	for _, name := range goldens {
+		if b, err := os.ReadFile(name); err == nil {
+			f.Add(b)
+		}
+	}
+	f.Add(pngStream(1<<31-1, 1<<31-1, 8, 6, []byte{0, 1, 2, 3, 4}))
+	f.Add(pngStream(3, 2, 1, 0, []byte{0, 0xA0, 1, 0x40}))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		// Without options, as png2gif reads its sources.
+		data, err := ReadPng(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+		if len(data.frames) == 0 {
+			t.Fatal("no frames without an error")
+		}
+		WriteGif(io.Discard, data)
+		WritePng(io.Discard, data)
+	})
+}
@@ -3,10 +3,8 @@ package main
 import (
 	"compress/lzw"
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"io"
-	"log"
 	"math"
 )
 
@@ -24,7 +22,7 @@ type logicalScreenDescriptor struct {
 	SizeOfGlobalColorTable uint
 	BackgroundColorIndex   byte
 	PixelAspectRatio       byte
-	GlobalColorTable       []byte
+	GlobalColorTable       []byte `json:"-"`
 }
 
 type imageDescriptor struct {
@@ -36,7 +34,7 @@ type imageDescriptor struct {
 	InterlaceFlag         bool
 	SortFlag              bool
 	SizeOfLocalColorTable uint
-	LocalColorTable       []byte
+	LocalColorTable       []byte `json:"-"`
 }
 
 type graphicControlExtension struct {
@@ -50,6 +48,7 @@ type graphicControlExtension struct {
 type applicationExtension struct {
 	ApplicationIdentifier         [8]byte
 	ApplicationAuthenticationCode [3]byte
+	ApplicationData               [][]byte `json:"-"`
 }
 
 func (v *header) String() string {
@@ -139,6 +138,9 @@ func readByte(r io.Reader) (byte, error) {
 	var buf [1]byte
 	n, err := r.Read(buf[:])
 	if n == 0 {
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
 		return 0, io.ErrUnexpectedEOF
 	}
 	return buf[0], err
@@ -192,7 +194,7 @@ const (
 
 func (v *header) UnmarshalBinary(data []byte) error {
 	if len(data) < headerSize {
-		return fmt.Errorf("Len is not enough. required: %d, actual: %d", headerSize, len(data))
+		return formatError("Len is not enough. required: %d, actual: %d", headerSize, len(data))
 	}
 	v.Signature = string(data[:3])
 	v.Version = string(data[3:6])
@@ -201,7 +203,7 @@ func (v *header) UnmarshalBinary(data []byte) error {
 
 func (v *logicalScreenDescriptor) UnmarshalBinary(data []byte) error {
 	if len(data) < logicalScreenDescriptorSize {
-		return fmt.Errorf("Len is not enough. required: %d, actual: %d", logicalScreenDescriptorSize, len(data))
+		return formatError("Len is not enough. required: %d, actual: %d", logicalScreenDescriptorSize, len(data))
 	}
 	v.LogicalScreenWidth = binary.LittleEndian.Uint16(data[:])
 	v.LogicalScreenHeight = binary.LittleEndian.Uint16(data[2:])
@@ -220,7 +222,7 @@ func (v *logicalScreenDescriptor) UnmarshalBinary(data []byte) error {
 
 func (v *imageDescriptor) UnmarshalBinary(data []byte) error {
 	if len(data) < imageDescriptorSize {
-		return fmt.Errorf("Len is not enough. required: %d, actual: %d", imageDescriptorSize, len(data))
+		return formatError("Len is not enough. required: %d, actual: %d", imageDescriptorSize, len(data))
 	}
 	v.ImageLeftPosition = binary.LittleEndian.Uint16(data[0:])
 	v.ImageTopPosition = binary.LittleEndian.Uint16(data[2:])
@@ -239,7 +241,7 @@ func (v *imageDescriptor) UnmarshalBinary(data []byte) error {
 
 func (v *graphicControlExtension) UnmarshalBinary(data []byte) error {
 	if len(data) < graphicControlExtensionSize {
-		return fmt.Errorf("Len is not enough. required: %d, actual: %d", graphicControlExtensionSize, len(data))
+		return formatError("Len is not enough. required: %d, actual: %d", graphicControlExtensionSize, len(data))
 	}
 	v.DisposalMethod = int(data[0] >> 2 & 7)
 	v.UserInputFlag = data[0]>>1&1 == 1
@@ -251,7 +253,7 @@ func (v *graphicControlExtension) UnmarshalBinary(data []byte) error {
 
 func (v *applicationExtension) UnmarshalBinary(data []byte) error {
 	if len(data) < applicationExtensionSize {
-		return fmt.Errorf("Len is not enough. required: %d, actual: %d", applicationExtensionSize, len(data))
+		return formatError("Len is not enough. required: %d, actual: %d", applicationExtensionSize, len(data))
 	}
 	copy(v.ApplicationIdentifier[:], data[:8])
 	copy(v.ApplicationAuthenticationCode[:], data[8:11])
@@ -270,7 +272,7 @@ func readHeadser(r io.Reader) (*header, error) {
 	}
 	h.UnmarshalBinary(buf[:])
 	if h.Signature != "GIF" {
-		return nil, fmt.Errorf("Unknown signature: %s", h.Signature)
+		return nil, formatError("Unknown signature: %s", h.Signature)
 	}
 
 	knownVersions := make(map[string]struct{})
@@ -278,7 +280,7 @@ func readHeadser(r io.Reader) (*header, error) {
 	knownVersions["89a"] = struct{}{}
 
 	if _, known := knownVersions[h.Version]; !known {
-		return nil, fmt.Errorf("Unknown version: %s", h.Version)
+		return nil, formatError("Unknown version: %s", h.Version)
 	}
 
 	return &h, nil
@@ -313,7 +315,7 @@ func readBlock(r io.Reader, buf []byte) error {
 		return err
 	}
 	if int(size) != len(buf) {
-		return fmt.Errorf("buf size error: block size is %d, but buf size is %d", size, len(buf))
+		return formatError("buf size error: block size is %d, but buf size is %d", size, len(buf))
 	}
 
 	_, err = io.ReadFull(r, buf[:])
@@ -337,6 +339,31 @@ func skipBlock(r io.Reader) error {
 	}
 }
 
+// readSubBlocks reads data sub-blocks, adding their sizes to *totalBytes and
+// stopping with a LimitError once it exceeds maxTotalBytes.
+func readSubBlocks(r io.Reader, totalBytes *int64, maxTotalBytes int64) ([][]byte, error) {
+	var blocks [][]byte
+	for {
+		size, err := readByte(r)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return blocks, nil
+		}
+		*totalBytes += int64(size)
+		if err := checkLimit("MaxTotalBytes", maxTotalBytes, *totalBytes); err != nil {
+			return nil, err
+		}
+		b := make([]byte, size)
+		_, err = io.ReadFull(r, b)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, b)
+	}
+}
+
 func readImageDescriptor(r io.Reader) (*imageDescriptor, error) {
 	var (
 		i   imageDescriptor
@@ -360,7 +387,34 @@ func readImageDescriptor(r io.Reader) (*imageDescriptor, error) {
 	return &i, nil
 }
 
-func readTableBasedImageData(r io.Reader, width int, height int) (*ImageFrame, error) {
+// lzwLimitReader passes on at most max bytes of LZW output, and fails with a
+// LimitError if the decoder produces more.
+type lzwLimitReader struct {
+	r   io.Reader
+	max int64
+	n   int64
+}
+
+func (v *lzwLimitReader) Read(p []byte) (int, error) {
+	if v.max <= 0 {
+		return v.r.Read(p)
+	}
+	if v.n >= v.max {
+		var b [1]byte
+		n, err := v.r.Read(b[:])
+		if n == 0 {
+			return 0, err
+		}
+		return 0, &LimitError{Limit: "MaxLZWOutput", Max: v.max, Actual: v.n + 1}
+	}
+	n, err := v.r.Read(p[:min(len(p), int(v.max-v.n))])
+	v.n += int64(n)
+	return n, err
+}
+
+// readTableBasedImageData decodes the pixels of a frame. A positive maxOutput
+// limits the bytes read from the LZW decoder.
+func readTableBasedImageData(r io.Reader, width int, height int, maxOutput int) (*ImageFrame, error) {
 	var frame ImageFrame
 
 	frame.width = width
@@ -373,7 +427,7 @@ func readTableBasedImageData(r io.Reader, width int, height int) (*ImageFrame, e
 	}
 	lr := lzw.NewReader(newBlockReader(r), lzw.LSB, int(litWidth))
 	defer lr.Close()
-	_, err = io.ReadFull(lr, frame.data)
+	_, err = io.ReadFull(&lzwLimitReader{r: lr, max: int64(maxOutput)}, frame.data)
 	if err != nil {
 		return nil, err
 	}
@@ -403,7 +457,9 @@ func readGraphicControlExtension(r io.Reader) (*graphicControlExtension, error)
 	return &g, nil
 }
 
-func readApplicationExtension(r io.Reader) (*applicationExtension, error) {
+// readApplicationExtension reads an application extension, counting its data
+// towards totalBytes like readSubBlocks.
+func readApplicationExtension(r io.Reader, totalBytes *int64, maxTotalBytes int64) (*applicationExtension, error) {
 	var (
 		a   applicationExtension
 		buf [applicationExtensionSize]byte
@@ -413,7 +469,11 @@ func readApplicationExtension(r io.Reader) (*applicationExtension, error) {
 		return nil, err
 	}
 	if n != applicationExtensionSize {
-		return nil, fmt.Errorf("Unexpected block size. expected: %d, actual: %d", applicationExtensionSize, n)
+		_, err = io.CopyN(io.Discard, r, int64(n))
+		if err != nil {
+			return nil, err
+		}
+		return nil, skipBlock(r)
 	}
 
 	_, err = io.ReadFull(r, buf[:])
@@ -422,13 +482,33 @@ func readApplicationExtension(r io.Reader) (*applicationExtension, error) {
 	}
 	a.UnmarshalBinary(buf[:])
 
-	err = skipBlock(r)
+	a.ApplicationData, err = readSubBlocks(r, totalBytes, maxTotalBytes)
 	if err != nil {
 		return nil, err
 	}
 	return &a, nil
 }
 
+// loopCount returns the number of times the animation plays as set by a
+// NETSCAPE2.0 extension, which counts the repetitions after the first play.
+// Zero means forever.
+func (v *applicationExtension) loopCount() (int, bool) {
+	id := string(v.ApplicationIdentifier[:]) + string(v.ApplicationAuthenticationCode[:])
+	if id != "NETSCAPE2.0" && id != "ANIMEXTS1.0" {
+		return 0, false
+	}
+	if len(v.ApplicationData) == 0 || len(v.ApplicationData[0]) != 3 || v.ApplicationData[0][0] != 1 {
+		return 0, false
+	}
+	loops := int(binary.LittleEndian.Uint16(v.ApplicationData[0][1:]))
+	if loops == 0 {
+		return 0, true
+	}
+	return loops + 1, true
+}
+
+// deinterlace reorders the rows of frame into display order.
+// Rows missing from short frame data stay zero.
 func deinterlace(frame *ImageFrame, width, height int) []byte {
 	startingRow := [4]int{0, 4, 2, 1}
 	rowSkipSize := [4]int{8, 8, 4, 2}
@@ -438,38 +518,119 @@ func deinterlace(frame *ImageFrame, width, height int) []byte {
 
 	for i := 0; i < 4; i++ {
 		for sy := startingRow[i]; sy < height; sy += rowSkipSize[i] {
-			copy(d[dy*width:(dy+1)*width], frame.data[sy*width:(sy+1)*width])
+			if (dy+1)*width > len(frame.data) {
+				return d
+			}
+			copy(d[sy*width:(sy+1)*width], frame.data[dy*width:(dy+1)*width])
+			dy++
 		}
 	}
 
 	return d
 }
 
-func validateNoMultipleColorTables(data *ImageData) error {
-	const errorMessage = "Not supported: Animation GIF with LocalColorTable"
-	if (data.palette == nil) && len(data.frames) > 1 {
-		return errors.New(errorMessage)
+func extensionName(label byte) string {
+	switch label {
+	case 0xF9:
+		return "Graphic Control Extension"
+	case 0xFE:
+		return "Comment Extension"
+	case 0x01:
+		return "Plain Text Extension"
+	case 0xFF:
+		return "Application Extension"
 	}
-	for i := range data.frames[1:] {
-		if data.frames[i].palette != nil {
-			return errors.New(errorMessage)
-		}
+	return fmt.Sprintf("Extension 0x%02x", label)
+}
+
+// DecodeOptions configures ReadGifWithOptions and ReadPngWithOptions.
+// A zero limit field means no limit.
+type DecodeOptions struct {
+	// MaxCanvasPixels limits the size of the logical screen and of every frame.
+	MaxCanvasPixels int
+	MaxFrames       int
+	// MaxTotalBytes limits the color tables, frame pixels and extension data kept.
+	MaxTotalBytes int64
+	// MaxLZWOutput limits the bytes decoded from the image data of a frame.
+	MaxLZWOutput int
+
+	// Observer receives an event for every block read.
+	Observer DecodeObserver
+
+	// KeepUnknownExtensions records extensions with unknown labels in ImageData
+	// instead of just skipping them.
+	KeepUnknownExtensions bool
+}
+
+func checkLimit(limit string, max int64, actual int64) error {
+	if max > 0 && actual > max {
+		return &LimitError{Limit: limit, Max: max, Actual: actual}
 	}
 	return nil
 }
 
+func (v *DecodeOptions) checkCanvas(width, height int) error {
+	if v == nil {
+		return nil
+	}
+	return checkLimit("MaxCanvasPixels", int64(v.MaxCanvasPixels), int64(width)*int64(height))
+}
+
+// checkFrame checks a frame before its pixels are allocated. Frames may extend
+// past the canvas, so their size is held to MaxCanvasPixels as well.
+func (v *DecodeOptions) checkFrame(frames int, width, height int, totalBytes int64) error {
+	if v == nil {
+		return nil
+	}
+	if err := checkLimit("MaxFrames", int64(v.MaxFrames), int64(frames)); err != nil {
+		return err
+	}
+	if err := checkLimit("MaxCanvasPixels", int64(v.MaxCanvasPixels), int64(width)*int64(height)); err != nil {
+		return err
+	}
+	return checkLimit("MaxTotalBytes", v.MaxTotalBytes, totalBytes)
+}
+
 // ReadGif reads the image data from reader as GIF format.
+// If verbose is true, the blocks are logged with the standard logger.
 func ReadGif(r io.Reader, verbose bool) (*ImageData, error) {
+	var opts DecodeOptions
+	if verbose {
+		opts.Observer = &LogObserver{}
+	}
+	return ReadGifWithOptions(r, &opts)
+}
+
+// ReadGifWithOptions reads the image data from reader as GIF format as configured by opts.
+// Errors are reported as *FormatError, *UnsupportedError, *TruncatedError or *LimitError
+// unless the reader itself fails.
+func ReadGifWithOptions(r io.Reader, opts *DecodeOptions) (*ImageData, error) {
+	cr := &countingReader{r: r}
+	var pos ErrorPosition
+	data, err := readGif(cr, &pos, opts)
+	if err != nil {
+		return nil, withPosition(err, cr, pos)
+	}
+	return data, nil
+}
+
+func (v *ErrorPosition) moveTo(block string, r *countingReader, frame int) {
+	v.Block = block
+	v.Offset = r.n
+	v.Frame = frame
+}
+
+func readGif(r *countingReader, pos *ErrorPosition, opts *DecodeOptions) (*ImageData, error) {
 	var data ImageData
 
+	pos.moveTo("Header", r, 0)
 	h, err := readHeadser(r)
 	if err != nil {
 		return nil, err
 	}
-	if verbose {
-		log.Printf("GIF Header: %s\n", h)
-	}
+	opts.notify(&HeaderEvent{Offset: pos.Offset, Signature: h.Signature, Version: h.Version})
 
+	pos.moveTo("Logical Screen Descriptor", r, 0)
 	l, err := readLogicalScreenDescriptor(r)
 	if err != nil {
 		return nil, err
@@ -477,19 +638,38 @@ func ReadGif(r io.Reader, verbose bool) (*ImageData, error) {
 
 	data.width = int(l.LogicalScreenWidth)
 	data.height = int(l.LogicalScreenHeight)
-
-	if verbose {
-		log.Printf("Logical Screen Descriptor: %s\n", l)
+	data.backgroundIndex = int(l.BackgroundColorIndex)
+	if err := opts.checkCanvas(data.width, data.height); err != nil {
+		return nil, err
+	}
+	totalBytes := int64(len(l.GlobalColorTable))
+	var maxTotalBytes int64
+	maxLZWOutput := 0
+	if opts != nil {
+		maxTotalBytes, maxLZWOutput = opts.MaxTotalBytes, opts.MaxLZWOutput
 	}
 
+	opts.notify(&ScreenDescriptorEvent{
+		Offset:               pos.Offset,
+		Width:                data.width,
+		Height:               data.height,
+		GlobalColorTableSize: int(l.SizeOfGlobalColorTable),
+		BackgroundColorIndex: int(l.BackgroundColorIndex),
+		PixelAspectRatio:     int(l.PixelAspectRatio),
+	})
+
 	if l.GlobalColorTableFlag {
 		data.palette = make([]Rgb, l.SizeOfGlobalColorTable)
 		data.palette.UnmarshalBinary(l.GlobalColorTable)
 	}
 
+	// Without a NETSCAPE2.0 extension, the animation plays once.
+	data.loopCount = 1
 	nextDelay := 0
+	nextDisposal := 0
 	nextTransparencyIndex := -1
 	for {
+		pos.moveTo("Block Introducer", r, len(data.frames))
 		b, err := readByte(r)
 		if err != nil {
 			return nil, err
@@ -497,21 +677,44 @@ func ReadGif(r io.Reader, verbose bool) (*ImageData, error) {
 
 		switch b {
 		case 0x2C:
+			pos.Block = "Image Descriptor"
 			i, err := readImageDescriptor(r)
 			if err != nil {
 				return nil, err
 			}
-			if verbose {
-				log.Printf("Image Descriptor: %s\n", i)
+			opts.notify(&ImageEvent{
+				Offset:              pos.Offset,
+				Frame:               len(data.frames),
+				Left:                int(i.ImageLeftPosition),
+				Top:                 int(i.ImageTopPosition),
+				Width:               int(i.ImageWidth),
+				Height:              int(i.ImageHeight),
+				Interlaced:          i.InterlaceFlag,
+				LocalColorTableSize: int(i.SizeOfLocalColorTable),
+			})
+			if int(i.ImageLeftPosition)+int(i.ImageWidth) > data.width || int(i.ImageTopPosition)+int(i.ImageHeight) > data.height {
+				opts.notify(&WarningEvent{
+					Offset:  pos.Offset,
+					Frame:   len(data.frames),
+					Message: "Image exceeds the logical screen",
+				})
+			}
+
+			totalBytes += int64(len(i.LocalColorTable)) + int64(i.ImageWidth)*int64(i.ImageHeight)
+			err = opts.checkFrame(len(data.frames)+1, int(i.ImageWidth), int(i.ImageHeight), totalBytes)
+			if err != nil {
+				return nil, err
 			}
 
-			frame, err := readTableBasedImageData(r, int(i.ImageWidth), int(i.ImageHeight))
+			pos.moveTo("Image Data", r, len(data.frames))
+			frame, err := readTableBasedImageData(r, int(i.ImageWidth), int(i.ImageHeight), maxLZWOutput)
 			if err != nil {
 				return nil, err
 			}
 			frame.xOffset = int(i.ImageLeftPosition)
 			frame.yOffset = int(i.ImageTopPosition)
 			frame.delay = nextDelay
+			frame.disposal = nextDisposal
 			frame.transparencyIndex = nextTransparencyIndex
 
 			if i.LocalColorTableFlag {
@@ -525,10 +728,12 @@ func ReadGif(r io.Reader, verbose bool) (*ImageData, error) {
 
 			data.frames = append(data.frames, *frame)
 		case 0x21:
+			pos.Block = "Extension"
 			b, err := readByte(r)
 			if err != nil {
 				return nil, err
 			}
+			pos.Block = extensionName(b)
 
 			switch b {
 			case 0xF9:
@@ -537,49 +742,77 @@ func ReadGif(r io.Reader, verbose bool) (*ImageData, error) {
 				if err != nil {
 					return nil, err
 				}
-				if verbose {
-					log.Printf("Graphic Control Extension: %s\n", g)
-				}
 				nextDelay = int(g.DelayTime)
+				nextDisposal = g.DisposalMethod
 				if g.TransparentColorFlag {
 					nextTransparencyIndex = int(g.TransparentColorIndex)
 				} else {
 					nextTransparencyIndex = -1
 				}
+				opts.notify(&GraphicControlEvent{
+					Offset:            pos.Offset,
+					Frame:             len(data.frames),
+					DisposalMethod:    g.DisposalMethod,
+					UserInput:         g.UserInputFlag,
+					Delay:             nextDelay,
+					TransparencyIndex: nextTransparencyIndex,
+				})
 			case 0xFE:
 				//Comment Extension
-				if verbose {
-					log.Println("Skip Comment Extension")
-				}
+				opts.notify(&ExtensionEvent{Offset: pos.Offset, Frame: len(data.frames), Label: b, Skipped: true})
 				err := skipBlock(r)
 				if err != nil {
 					return nil, err
 				}
 			case 0x01:
 				//Plain Text Extension
-				if verbose {
-					log.Println("Skip Plain Text Extension")
-				}
+				opts.notify(&ExtensionEvent{Offset: pos.Offset, Frame: len(data.frames), Label: b, Skipped: true})
 				err := skipBlock(r)
 				if err != nil {
 					return nil, err
 				}
 			case 0xFF:
 				//Application Extension
-				a, err := readApplicationExtension(r)
+				a, err := readApplicationExtension(r, &totalBytes, maxTotalBytes)
 				if err != nil {
 					return nil, err
 				}
-				if verbose {
-					log.Printf("Application Extension: %s\n", a)
+				if a != nil {
+					opts.notify(&ExtensionEvent{Offset: pos.Offset, Frame: len(data.frames), Label: b, Application: a.String()})
+					if loops, ok := a.loopCount(); ok {
+						data.loopCount = loops
+					}
+				} else {
+					opts.notify(&WarningEvent{
+						Offset:  pos.Offset,
+						Frame:   len(data.frames),
+						Message: "Application Extension with unexpected block size skipped",
+					})
 				}
 			default:
-				return nil, fmt.Errorf("Unknown code: 0x21%02x", b)
+				if opts == nil || !opts.KeepUnknownExtensions {
+					opts.notify(&ExtensionEvent{Offset: pos.Offset, Frame: len(data.frames), Label: b, Skipped: true})
+					err := skipBlock(r)
+					if err != nil {
+						return nil, err
+					}
+					break
+				}
+				blocks, err := readSubBlocks(r, &totalBytes, maxTotalBytes)
+				if err != nil {
+					return nil, err
+				}
+				opts.notify(&ExtensionEvent{Offset: pos.Offset, Frame: len(data.frames), Label: b})
+				data.extensions = append(data.extensions, extension{
+					label:  b,
+					blocks: blocks,
+					frame:  len(data.frames),
+				})
 			}
 		case 0x3b:
-			err := validateNoMultipleColorTables(&data)
-			if err != nil {
-				return nil, err
+			pos.Block = "Trailer"
+			if len(data.frames) == 0 {
+				return nil, formatError("No image before the trailer")
 			}
 			if data.palette == nil {
 				data.palette = data.frames[0].palette
@@ -591,7 +824,7 @@ func ReadGif(r io.Reader, verbose bool) (*ImageData, error) {
 			}
 			return &data, nil
 		default:
-			return nil, fmt.Errorf("Unknown code: 0x%02x", b)
+			return nil, formatError("Unknown code: 0x%02x", b)
 		}
 	}
 }
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"compress/lzw"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+type blockWriter struct {
+	buf    [255]byte
+	bufLen int
+	w      io.Writer
+}
+
+func newBlockWriter(w io.Writer) *blockWriter {
+	return &blockWriter{w: w}
+}
+
+func (v *blockWriter) writeBlock() error {
+	if v.bufLen == 0 {
+		return nil
+	}
+	if _, err := v.w.Write([]byte{byte(v.bufLen)}); err != nil {
+		return err
+	}
+	if _, err := v.w.Write(v.buf[:v.bufLen]); err != nil {
+		return err
+	}
+	v.bufLen = 0
+	return nil
+}
+
+// Write splits p into data sub-blocks of at most 255 bytes.
+func (v *blockWriter) Write(p []byte) (n int, err error) {
+	for n < len(p) {
+		if v.bufLen == len(v.buf) {
+			if err = v.writeBlock(); err != nil {
+				return n, err
+			}
+		}
+		c := copy(v.buf[v.bufLen:], p[n:])
+		v.bufLen += c
+		n += c
+	}
+	return n, nil
+}
+
+// Close writes the buffered sub-block and the block terminator.
+func (v *blockWriter) Close() error {
+	if err := v.writeBlock(); err != nil {
+		return err
+	}
+	_, err := v.w.Write([]byte{0})
+	return err
+}
+
+// colorTableSize returns the size field of a color table holding n colors.
+// The table holds 2^(size+1) colors.
+func colorTableSize(n int) uint {
+	size := uint(0)
+	for 1<<(size+1) < n {
+		size++
+	}
+	return size
+}
+
+func marshalColorTable(p Palette) []byte {
+	b, _ := p.MarshalBinary()
+	return append(b, make([]byte, 3<<(colorTableSize(len(p))+1)-len(b))...)
+}
+
+func (v *header) MarshalBinary() ([]byte, error) {
+	return []byte(v.Signature + v.Version), nil
+}
+
+func (v *logicalScreenDescriptor) MarshalBinary() ([]byte, error) {
+	data := make([]byte, logicalScreenDescriptorSize)
+	binary.LittleEndian.PutUint16(data[0:], v.LogicalScreenWidth)
+	binary.LittleEndian.PutUint16(data[2:], v.LogicalScreenHeight)
+	data[4] = (v.ColorResolution - 1) & 7 << 4
+	if v.GlobalColorTableFlag {
+		data[4] |= 1<<7 | byte(colorTableSize(int(v.SizeOfGlobalColorTable)))
+	}
+	if v.SortFlag {
+		data[4] |= 1 << 3
+	}
+	data[5] = v.BackgroundColorIndex
+	data[6] = v.PixelAspectRatio
+	return append(data, v.GlobalColorTable...), nil
+}
+
+func (v *imageDescriptor) MarshalBinary() ([]byte, error) {
+	data := make([]byte, imageDescriptorSize)
+	binary.LittleEndian.PutUint16(data[0:], v.ImageLeftPosition)
+	binary.LittleEndian.PutUint16(data[2:], v.ImageTopPosition)
+	binary.LittleEndian.PutUint16(data[4:], v.ImageWidth)
+	binary.LittleEndian.PutUint16(data[6:], v.ImageHeight)
+	if v.LocalColorTableFlag {
+		data[8] |= 1<<7 | byte(colorTableSize(int(v.SizeOfLocalColorTable)))
+	}
+	if v.InterlaceFlag {
+		data[8] |= 1 << 6
+	}
+	if v.SortFlag {
+		data[8] |= 1 << 5
+	}
+	return append(data, v.LocalColorTable...), nil
+}
+
+func (v *graphicControlExtension) MarshalBinary() ([]byte, error) {
+	data := make([]byte, graphicControlExtensionSize)
+	data[0] = byte(v.DisposalMethod&7) << 2
+	if v.UserInputFlag {
+		data[0] |= 1 << 1
+	}
+	if v.TransparentColorFlag {
+		data[0] |= 1
+	}
+	binary.LittleEndian.PutUint16(data[1:], v.DelayTime)
+	data[3] = v.TransparentColorIndex
+	return data, nil
+}
+
+func (v *applicationExtension) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, applicationExtensionSize)
+	data = append(data, v.ApplicationIdentifier[:]...)
+	return append(data, v.ApplicationAuthenticationCode[:]...), nil
+}
+
+func writeGifHeader(w io.Writer) error {
+	b, _ := (&header{Signature: "GIF", Version: "89a"}).MarshalBinary()
+	_, err := w.Write(b)
+	return err
+}
+
+func writeLogicalScreenDescriptor(w io.Writer, data *ImageData) error {
+	l := logicalScreenDescriptor{
+		LogicalScreenWidth:  uint16(data.width),
+		LogicalScreenHeight: uint16(data.height),
+		ColorResolution:     8,
+	}
+	if data.palette != nil {
+		l.GlobalColorTableFlag = true
+		l.GlobalColorTable = marshalColorTable(data.palette)
+		l.SizeOfGlobalColorTable = uint(len(l.GlobalColorTable) / 3)
+		if data.backgroundIndex < len(data.palette) {
+			l.BackgroundColorIndex = byte(data.backgroundIndex)
+		}
+	}
+	b, _ := l.MarshalBinary()
+	_, err := w.Write(b)
+	return err
+}
+
+// writeLoopExtension writes the NETSCAPE2.0 application extension.
+// Zero loops means forever.
+func writeLoopExtension(w io.Writer, loops int) error {
+	var a applicationExtension
+	copy(a.ApplicationIdentifier[:], "NETSCAPE")
+	copy(a.ApplicationAuthenticationCode[:], "2.0")
+	b, _ := a.MarshalBinary()
+	if _, err := w.Write([]byte{0x21, 0xFF, applicationExtensionSize}); err != nil {
+		return err
+	}
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	bw := newBlockWriter(w)
+	if _, err := bw.Write([]byte{1, byte(loops), byte(loops >> 8)}); err != nil {
+		return err
+	}
+	return bw.Close()
+}
+
+func writeExtension(w io.Writer, e *extension) error {
+	if _, err := w.Write([]byte{0x21, e.label}); err != nil {
+		return err
+	}
+	for _, block := range e.blocks {
+		if _, err := w.Write(append([]byte{byte(len(block))}, block...)); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write([]byte{0})
+	return err
+}
+
+func writeGraphicControlExtension(w io.Writer, frame *ImageFrame) error {
+	g := graphicControlExtension{
+		DisposalMethod: frame.disposal,
+		DelayTime:      uint16(min(frame.delay, 0xFFFF)),
+	}
+	if frame.transparencyIndex != -1 {
+		g.TransparentColorFlag = true
+		g.TransparentColorIndex = byte(frame.transparencyIndex)
+	}
+	b, _ := g.MarshalBinary()
+	if _, err := w.Write([]byte{0x21, 0xF9, graphicControlExtensionSize}); err != nil {
+		return err
+	}
+	if _, err := w.Write(append(b, 0)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// lzwMinimumCodeSize returns the code size which holds every index of the frame
+// and every entry of its color table.
+func lzwMinimumCodeSize(frame *ImageFrame, colors int) int {
+	size := 2
+	for 1<<size < colors {
+		size++
+	}
+	for _, c := range frame.data {
+		for int(c) >= 1<<size {
+			size++
+		}
+	}
+	return size
+}
+
+func writeImage(w io.Writer, frame *ImageFrame, colors int) error {
+	i := imageDescriptor{
+		ImageLeftPosition: uint16(frame.xOffset),
+		ImageTopPosition:  uint16(frame.yOffset),
+		ImageWidth:        uint16(frame.width),
+		ImageHeight:       uint16(frame.height),
+	}
+	if frame.palette != nil {
+		i.LocalColorTableFlag = true
+		i.LocalColorTable = marshalColorTable(frame.palette)
+		i.SizeOfLocalColorTable = uint(len(i.LocalColorTable) / 3)
+		colors = len(frame.palette)
+	}
+	b, _ := i.MarshalBinary()
+	if _, err := w.Write(append([]byte{0x2C}, b...)); err != nil {
+		return err
+	}
+
+	litWidth := lzwMinimumCodeSize(frame, colors)
+	if _, err := w.Write([]byte{byte(litWidth)}); err != nil {
+		return err
+	}
+	bw := newBlockWriter(w)
+	lw := lzw.NewWriter(bw, lzw.LSB, litWidth)
+	if _, err := lw.Write(frame.data); err != nil {
+		return err
+	}
+	if err := lw.Close(); err != nil {
+		return err
+	}
+	return bw.Close()
+}
+
+// hasSourceFrames reports whether a frame replaces the pixels below it,
+// which GIF can not express.
+func hasSourceFrames(data *ImageData) bool {
+	for _, f := range data.frames {
+		if f.source {
+			return true
+		}
+	}
+	return false
+}
+
+// checkGifSize returns an error if a size or offset of data does not fit the
+// 16 bits GIF stores it in.
+func checkGifSize(data *ImageData) error {
+	if data.width > 0xFFFF || data.height > 0xFFFF {
+		return &UnsupportedError{Feature: fmt.Sprintf("GIF screen size %dx%d", data.width, data.height)}
+	}
+	for i, f := range data.frames {
+		if f.width > 0xFFFF || f.height > 0xFFFF || f.xOffset > 0xFFFF || f.yOffset > 0xFFFF {
+			return &UnsupportedError{Feature: fmt.Sprintf("GIF frame %d of %dx%d at (%d, %d)", i, f.width, f.height, f.xOffset, f.yOffset)}
+		}
+	}
+	return nil
+}
+
+// WriteGif writes the image data to writer in GIF format.
+// Truecolor data is reduced to palettes first, see gifPalettes.
+// Animations play data.loopCount times, forever if it is zero, as read from the
+// source. Extensions kept by ReadGifWithOptions are written back. Sizes and
+// offsets above 65535 are an UnsupportedError.
+func WriteGif(w io.Writer, data *ImageData) error {
+	if err := checkGifSize(data); err != nil {
+		return err
+	}
+	if len(data.frames) > 1 && hasSourceFrames(data) {
+		c := *data
+		c.frames = compositeFrames(data)
+		data = &c
+	}
+	data = gifPalettes(data)
+
+	if err := writeGifHeader(w); err != nil {
+		return err
+	}
+	if err := writeLogicalScreenDescriptor(w, data); err != nil {
+		return err
+	}
+	// Without the loop extension, the animation plays once.
+	if len(data.frames) > 1 && data.loopCount != 1 {
+		loops := 0
+		if data.loopCount > 1 {
+			loops = min(data.loopCount-1, math.MaxUint16)
+		}
+		if err := writeLoopExtension(w, loops); err != nil {
+			return err
+		}
+	}
+	writeExtensions := func(frame int) error {
+		for i := range data.extensions {
+			if data.extensions[i].frame == frame {
+				if err := writeExtension(w, &data.extensions[i]); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	for i := range data.frames {
+		f := &data.frames[i]
+		if err := writeExtensions(i); err != nil {
+			return err
+		}
+		if err := writeGraphicControlExtension(w, f); err != nil {
+			return err
+		}
+		if err := writeImage(w, f, len(data.palette)); err != nil {
+			return err
+		}
+	}
+	if err := writeExtensions(len(data.frames)); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte{0x3b})
+	return err
+}
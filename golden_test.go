@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"image/gif"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the corpus in testdata and the golden PNG files")
+
+func corpusPath(name string) string {
+	return filepath.Join("testdata", name+".gif")
+}
+
+func goldenPath(name string) string {
+	return filepath.Join("testdata", "golden", name+".png")
+}
+
+// checkFile compares b with the file at path, or writes it there with -update.
+func checkFile(t *testing.T, path string, b []byte) {
+	t.Helper()
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run go test -update to create it)", err)
+	}
+	if !bytes.Equal(b, want) {
+		t.Errorf("%s is out of date: %d bytes, want %d (run go test -update)", path, len(b), len(want))
+	}
+}
+
+func TestCorpusUpToDate(t *testing.T) {
+	for _, c := range corpus {
+		t.Run(c.name, func(t *testing.T) {
+			checkFile(t, corpusPath(c.name), c.gif())
+		})
+	}
+}
+
+func TestGolden(t *testing.T) {
+	for _, c := range corpus {
+		t.Run(c.name, func(t *testing.T) {
+			data, err := ReadGif(bytes.NewReader(c.gif()), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			if err := WritePng(&out, data); err != nil {
+				t.Fatal(err)
+			}
+			checkFile(t, goldenPath(c.name), out.Bytes())
+		})
+	}
+}
+
+func TestDecodeMatchesImageGif(t *testing.T) {
+	for _, c := range corpus {
+		if c.unknownExtension {
+			continue
+		}
+		t.Run(c.name, func(t *testing.T) {
+			b := c.gif()
+			data, err := ReadGif(bytes.NewReader(b), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			g, err := gif.DecodeAll(bytes.NewReader(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(data.frames) != len(g.Image) {
+				t.Fatalf("frames: %d, want %d", len(data.frames), len(g.Image))
+			}
+			for i, f := range data.frames {
+				m := g.Image[i]
+				if f.xOffset != m.Rect.Min.X || f.yOffset != m.Rect.Min.Y || f.width != m.Rect.Dx() || f.height != m.Rect.Dy() {
+					t.Errorf("frame %d: %dx%d at (%d, %d), want %v", i, f.width, f.height, f.xOffset, f.yOffset, m.Rect)
+				}
+				if f.delay != g.Delay[i] || f.disposal != int(g.Disposal[i]) {
+					t.Errorf("frame %d: delay %d disposal %d, want %d %d", i, f.delay, f.disposal, g.Delay[i], g.Disposal[i])
+				}
+				if !bytes.Equal(f.data, m.Pix) {
+					t.Errorf("frame %d: pixels differ", i)
+				}
+			}
+		})
+	}
+}
+
+func TestGoldenMatchesImageGif(t *testing.T) {
+	for _, c := range corpus {
+		if c.unknownExtension {
+			continue
+		}
+		t.Run(c.name, func(t *testing.T) {
+			want, err := ReadGifReference(bytes.NewReader(c.gif()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			golden, err := os.ReadFile(goldenPath(c.name))
+			if err != nil {
+				t.Skip(err)
+			}
+			if err := VerifyPng(bytes.NewReader(golden), want, nil); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestCorpusOptions(t *testing.T) {
+	options := map[string]*EncodeOptions{
+		"optimize-frames": {OptimizeFrames: true},
+		"merge":           {OptimizeFrames: true, MergeDuplicateFrames: true},
+		"rgba":            {ColorMode: ColorRGBA},
+		"palette":         {ColorMode: ColorPalette, Filter: FilterAdaptive},
+		"browser-delay":   {DelayPolicy: DelayBrowser, Speed: 2},
+		"poster":          {Poster: Poster{Mode: PosterMostColorful}, MaxChunkSize: 64},
+	}
+	for _, c := range corpus {
+		if c.unknownExtension {
+			continue
+		}
+		want, err := ReadGifReference(bytes.NewReader(c.gif()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ReadGif(bytes.NewReader(c.gif()), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, opts := range options {
+			t.Run(c.name+"/"+name, func(t *testing.T) {
+				var out bytes.Buffer
+				if err := WritePngWithOptions(&out, data, opts); err != nil {
+					t.Fatal(err)
+				}
+				if err := VerifyPng(&out, want, opts); err != nil {
+					t.Error(err)
+				}
+			})
+		}
+	}
+}
+
+func TestCorpusGifRoundTrip(t *testing.T) {
+	for _, c := range corpus {
+		if c.unknownExtension {
+			continue
+		}
+		t.Run(c.name, func(t *testing.T) {
+			want, err := ReadGifReference(bytes.NewReader(c.gif()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := ReadGif(bytes.NewReader(c.gif()), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var b bytes.Buffer
+			if err := WriteGif(&b, data); err != nil {
+				t.Fatal(err)
+			}
+			written, err := ReadGif(bytes.NewReader(b.Bytes()), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(data.frames) > 1 && written.loopCount != data.loopCount {
+				t.Errorf("loop count %d, want %d", written.loopCount, data.loopCount)
+			}
+			got, err := ReadGifReference(&b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			if err := WritePng(&out, want); err != nil {
+				t.Fatal(err)
+			}
+			if err := VerifyPng(&out, got, nil); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestUnknownExtensions(t *testing.T) {
+	b := corpusCaseNamed("unknown_extension").gif()
+	data, err := ReadGif(bytes.NewReader(b), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.extensions) != 0 {
+		t.Errorf("extensions kept without KeepUnknownExtensions: %d", len(data.extensions))
+	}
+
+	data, err = ReadGifWithOptions(bytes.NewReader(b), &DecodeOptions{KeepUnknownExtensions: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.extensions) != 2 || data.extensions[0].label != 0x99 || data.extensions[0].frame != 0 ||
+		data.extensions[1].label != 0x42 || data.extensions[1].frame != 1 {
+		t.Fatalf("extensions: %+v", data.extensions)
+	}
+	var out bytes.Buffer
+	if err := WriteGif(&out, data); err != nil {
+		t.Fatal(err)
+	}
+	again, err := ReadGifWithOptions(&out, &DecodeOptions{KeepUnknownExtensions: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again.extensions) != 2 || !bytes.Equal(again.extensions[0].blocks[1], []byte{1, 2, 3}) {
+		t.Errorf("extensions after WriteGif: %+v", again.extensions)
+	}
+}
+
+func TestWriteGifSize(t *testing.T) {
+	frame := func(width, height, x, y int) ImageFrame {
+		return ImageFrame{width: width, height: height, xOffset: x, yOffset: y, transparencyIndex: -1, data: make([]byte, width*height*4)}
+	}
+	for _, data := range []*ImageData{
+		{width: 70000, height: 10, frames: []ImageFrame{frame(70000, 10, 0, 0)}},
+		{width: 10, height: 70000, frames: []ImageFrame{frame(10, 70000, 0, 0)}},
+		{width: 10, height: 10, frames: []ImageFrame{frame(10, 10, 0, 0), frame(1, 1, 70000, 0)}},
+		{width: 10, height: 10, frames: []ImageFrame{frame(1, 1, 0, 70000)}},
+	} {
+		data.transparencyIndex, data.truecolor = -1, true
+		var out bytes.Buffer
+		err := WriteGif(&out, data)
+		var unsupported *UnsupportedError
+		if !errors.As(err, &unsupported) {
+			t.Errorf("%dx%d: got %v, want an UnsupportedError", data.width, data.height, err)
+		}
+		if out.Len() != 0 {
+			t.Errorf("%dx%d: %d bytes written", data.width, data.height, out.Len())
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+// grayFormat returns a grayscale format for palette frames whose colors are all gray,
+// at the smallest bit depth which holds every gray level and a level for tRNS.
+// If every 8 bit level is in use, transparency needs gray with alpha.
+func grayFormat(data *ImageData) (pngFormat, bool) {
+	if data.truecolor {
+		return pngFormat{}, false
+	}
+	var used [256]bool
+	for _, f := range data.frames {
+		for _, c := range f.data {
+			if int(c) != f.transparencyIndex {
+				used[c] = true
+			}
+		}
+	}
+	if data.transparencyIndex == -1 && data.backgroundIndex < len(data.palette) {
+		used[data.backgroundIndex] = true
+	}
+	for c := range used {
+		if !used[c] {
+			continue
+		}
+		if c >= len(data.palette) || data.palette[c].r != data.palette[c].g || data.palette[c].r != data.palette[c].b {
+			return pngFormat{}, false
+		}
+	}
+
+	for _, depth := range []byte{1, 2, 4, 8} {
+		levels := 1<<depth - 1
+		scale := 255 / byte(levels)
+		gray := make([]byte, 256)
+		taken := make([]bool, levels+1)
+		ok := true
+		for c := range used {
+			if !used[c] {
+				continue
+			}
+			if data.palette[c].r%scale != 0 {
+				ok = false
+				break
+			}
+			gray[c] = data.palette[c].r / scale
+			taken[gray[c]] = true
+		}
+		if !ok {
+			continue
+		}
+		if data.transparencyIndex == -1 {
+			return pngFormat{colorType: 0, bitDepth: depth, gray: gray, transparencyIndex: -1}, true
+		}
+		for level, t := range taken {
+			if !t {
+				gray[data.transparencyIndex] = byte(level)
+				return pngFormat{colorType: 0, bitDepth: depth, gray: gray, transparencyIndex: data.transparencyIndex}, true
+			}
+		}
+	}
+
+	gray := make([]byte, 256)
+	for c := range data.palette {
+		gray[c] = data.palette[c].r
+	}
+	return pngFormat{colorType: alphaUsed, bitDepth: 8, gray: gray, transparencyIndex: data.transparencyIndex}, true
+}
+
+// appendGrayRow appends palette indices as gray samples packed at the bit depth of v.
+func (v pngFormat) appendGrayRow(b []byte, row []byte) []byte {
+	if v.colorType&alphaUsed != 0 {
+		for _, c := range row {
+			if int(c) == v.transparencyIndex {
+				b = append(b, v.gray[c], 0)
+			} else {
+				b = append(b, v.gray[c], 255)
+			}
+		}
+		return b
+	}
+	return packSamples(b, row, v.bitDepth, v.gray)
+}
+
+// packSamples appends the samples of row, mapped through lookup if it is not nil,
+// packed at depth bits per sample with the first one in the high bits.
+func packSamples(b []byte, row []byte, depth byte, lookup []byte) []byte {
+	mask := byte(1<<depth - 1)
+	sample := func(c byte) byte {
+		if lookup != nil {
+			c = lookup[c]
+		}
+		return c & mask
+	}
+	if depth == 8 {
+		for _, c := range row {
+			b = append(b, sample(c))
+		}
+		return b
+	}
+	perByte := 8 / int(depth)
+	for i := 0; i < len(row); i += perByte {
+		var s byte
+		for j := 0; j < perByte; j++ {
+			s <<= depth
+			if i+j < len(row) {
+				s |= sample(row[i+j])
+			}
+		}
+		b = append(b, s)
+	}
+	return b
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	icoTypeIcon   = 1
+	icoTypeCursor = 2
+
+	icoMaxSize = 256
+)
+
+// IconOptions configures WriteIco.
+type IconOptions struct {
+	// Sizes lists the square sizes of the images. Frames which are not square are
+	// centered on a transparent square. Empty means one image per frame at the
+	// size of the logical screen, scaled down to fit 256.
+	Sizes []int
+
+	// Frames lists the composited frames the images are made of: one frame for all
+	// sizes, or one per size. Empty means the first frame.
+	Frames []int
+
+	// Cursor writes a .cur file, whose images have the hotspot at HotspotX,
+	// HotspotY of the logical screen, scaled with the image.
+	Cursor             bool
+	HotspotX, HotspotY int
+}
+
+// iconImage is a composited frame scaled to fit a square, or at its own size.
+type iconImage struct {
+	frame         int
+	width, height int
+}
+
+// iconImages returns the images described by icon.
+func iconImages(data *ImageData, frames int, icon *IconOptions) ([]iconImage, error) {
+	indices := icon.Frames
+	if len(indices) == 0 {
+		indices = []int{0}
+	}
+	for _, i := range indices {
+		if i < 0 || i >= frames {
+			return nil, fmt.Errorf("Frame index out of range: %d", i)
+		}
+	}
+
+	var images []iconImage
+	if len(icon.Sizes) == 0 {
+		width, height := data.width, data.height
+		if longest := max(width, height); longest > icoMaxSize {
+			width = max(1, int(math.Round(float64(width)*icoMaxSize/float64(longest))))
+			height = max(1, int(math.Round(float64(height)*icoMaxSize/float64(longest))))
+		}
+		for _, i := range indices {
+			images = append(images, iconImage{i, width, height})
+		}
+	} else {
+		if len(indices) != 1 && len(indices) != len(icon.Sizes) {
+			return nil, fmt.Errorf("Need one frame or one per size, got %d frames for %d sizes", len(indices), len(icon.Sizes))
+		}
+		for i, size := range icon.Sizes {
+			images = append(images, iconImage{indices[min(i, len(indices)-1)], size, size})
+		}
+	}
+
+	if len(images) > 0xFFFF {
+		return nil, &UnsupportedError{Feature: fmt.Sprintf("%d icon images", len(images))}
+	}
+	for _, image := range images {
+		if image.width <= 0 || image.height <= 0 || image.width > icoMaxSize || image.height > icoMaxSize {
+			return nil, &UnsupportedError{Feature: fmt.Sprintf("icon size %dx%d", image.width, image.height)}
+		}
+	}
+	return images, nil
+}
+
+// fitIcon scales an RGBA frame to fit into image, keeping its aspect ratio, and
+// returns the frame centered in it with the offset and scale it was drawn with.
+func fitIcon(f *ImageFrame, image iconImage) (*ImageFrame, int, int, float64) {
+	scale := math.Min(float64(image.width)/float64(f.width), float64(image.height)/float64(f.height))
+	w := max(1, int(math.Round(float64(f.width)*scale)))
+	h := max(1, int(math.Round(float64(f.height)*scale)))
+	x, y := (image.width-w)/2, (image.height-h)/2
+
+	resized := resizeRGBA(f, w, h)
+	pixels := make([]byte, image.width*image.height*4)
+	for row := 0; row < h; row++ {
+		copy(pixels[((y+row)*image.width+x)*4:], resized[row*w*4:(row+1)*w*4])
+	}
+	return &ImageFrame{
+		width:             image.width,
+		height:            image.height,
+		transparencyIndex: -1,
+		data:              pixels,
+	}, x, y, scale
+}
+
+// WriteIco writes an icon or cursor file to w whose images are composited frames
+// of data, resized as configured by icon and embedded as PNG. They are always
+// written as RGBA, which is the only color type all readers take; of opts, the
+// other options of the PNG encoder apply.
+func WriteIco(w io.Writer, data *ImageData, icon *IconOptions, opts *EncodeOptions) error {
+	if len(data.frames) == 0 {
+		return fmt.Errorf("No frames to write")
+	}
+	if data.width == 0 || data.height == 0 {
+		return &UnsupportedError{Feature: fmt.Sprintf("image size %dx%d", data.width, data.height)}
+	}
+	if icon.Cursor && (icon.HotspotX < 0 || icon.HotspotY < 0 || icon.HotspotX >= data.width || icon.HotspotY >= data.height) {
+		return fmt.Errorf("Hotspot outside the image: %d, %d", icon.HotspotX, icon.HotspotY)
+	}
+	pngOpts := EncodeOptions{}
+	if opts != nil {
+		pngOpts = *opts
+	}
+	pngOpts.ColorMode = ColorRGBA
+	pngOpts.BitDepth = 0
+	pngOpts.Optimize = false
+
+	composited := compositeFrames(toTruecolor(data))
+	images, err := iconImages(data, len(composited), icon)
+	if err != nil {
+		return err
+	}
+
+	kind := icoTypeIcon
+	if icon.Cursor {
+		kind = icoTypeCursor
+	}
+	header := binary.LittleEndian.AppendUint16([]byte{0, 0}, uint16(kind))
+	header = binary.LittleEndian.AppendUint16(header, uint16(len(images)))
+	var body []byte
+	offset := len(header) + 16*len(images)
+	for _, image := range images {
+		f, x, y, scale := fitIcon(&composited[image.frame], image)
+		var encoded bytes.Buffer
+		still := &ImageData{
+			width:             f.width,
+			height:            f.height,
+			transparencyIndex: -1,
+			truecolor:         true,
+			frames:            []ImageFrame{*f},
+		}
+		if err := WritePngWithOptions(&encoded, still, &pngOpts); err != nil {
+			return err
+		}
+
+		// A size of 256 is stored as 0.
+		header = append(header, byte(image.width), byte(image.height), 0, 0)
+		if icon.Cursor {
+			hx := min(x+int(float64(icon.HotspotX)*scale), image.width-1)
+			hy := min(y+int(float64(icon.HotspotY)*scale), image.height-1)
+			header = binary.LittleEndian.AppendUint16(header, uint16(hx))
+			header = binary.LittleEndian.AppendUint16(header, uint16(hy))
+		} else {
+			header = binary.LittleEndian.AppendUint16(header, 1)
+			header = binary.LittleEndian.AppendUint16(header, 32)
+		}
+		header = binary.LittleEndian.AppendUint32(header, uint32(encoded.Len()))
+		header = binary.LittleEndian.AppendUint32(header, uint32(offset+len(body)))
+		body = append(body, encoded.Bytes()...)
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err = w.Write(body)
+	return err
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestIco(t *testing.T) {
+	var c *corpusCase
+	for i := range corpus {
+		if corpus[i].name == "sub_rectangles" {
+			c = &corpus[i]
+		}
+	}
+	data, err := ReadGif(bytes.NewReader(c.gif()), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := len(data.frames) - 1
+
+	for _, icon := range []IconOptions{
+		{},
+		{Frames: []int{0, last}},
+		{Sizes: []int{16, 32, 256}},
+		{Sizes: []int{16, 48}, Frames: []int{0, last}},
+		{Sizes: []int{32}, Cursor: true, HotspotX: data.width / 2, HotspotY: data.height - 1},
+	} {
+		var out bytes.Buffer
+		if err := WriteIco(&out, data, &icon, nil); err != nil {
+			t.Fatal(err)
+		}
+		b := out.Bytes()
+		kind, count := binary.LittleEndian.Uint16(b[2:]), int(binary.LittleEndian.Uint16(b[4:]))
+		if icon.Cursor != (kind == icoTypeCursor) {
+			t.Errorf("%+v: type %d", icon, kind)
+		}
+		want := max(len(icon.Sizes), len(icon.Frames), 1)
+		if count != want {
+			t.Fatalf("%+v: %d images, want %d", icon, count, want)
+		}
+		for i := 0; i < count; i++ {
+			entry := b[6+16*i:]
+			size, offset := binary.LittleEndian.Uint32(entry[8:]), binary.LittleEndian.Uint32(entry[12:])
+			image, err := ReadPng(bytes.NewReader(b[offset : offset+size]))
+			if err != nil {
+				t.Fatalf("%+v: image %d: %v", icon, i, err)
+			}
+			if int(entry[0]) != image.width%256 || int(entry[1]) != image.height%256 {
+				t.Errorf("%+v: image %d is %dx%d, entry says %dx%d", icon, i, image.width, image.height, entry[0], entry[1])
+			}
+			if len(icon.Sizes) > 0 && (image.width != icon.Sizes[i] || image.height != icon.Sizes[i]) {
+				t.Errorf("%+v: image %d is %dx%d", icon, i, image.width, image.height)
+			}
+			if icon.Cursor {
+				x, y := int(binary.LittleEndian.Uint16(entry[4:])), int(binary.LittleEndian.Uint16(entry[6:]))
+				if x != 16 || y >= 32 || y < 16 {
+					t.Errorf("%+v: hotspot %d, %d", icon, x, y)
+				}
+			}
+		}
+	}
+
+	// Without sizes, a large screen is scaled down to fit 256.
+	large := &ImageData{width: 912, height: 684, transparencyIndex: -1, truecolor: true, frames: []ImageFrame{
+		{width: 912, height: 684, transparencyIndex: -1, data: make([]byte, 912*684*4)},
+	}}
+	var out bytes.Buffer
+	if err := WriteIco(&out, large, &IconOptions{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if b := out.Bytes(); binary.LittleEndian.Uint16(b[4:]) != 1 || b[6] != 0 || b[7] != 192 {
+		t.Errorf("large screen: %d images, first %dx%d", binary.LittleEndian.Uint16(b[4:]), b[6], b[7])
+	}
+
+	for _, icon := range []IconOptions{
+		{Sizes: []int{257}},
+		{Sizes: []int{16, 32}, Frames: []int{0, 0, 0}},
+		{Frames: []int{last + 1}},
+		{Cursor: true, HotspotX: data.width},
+	} {
+		if err := WriteIco(&bytes.Buffer{}, data, &icon, nil); err == nil {
+			t.Errorf("%+v: no error", icon)
+		}
+	}
+}
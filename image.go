@@ -1,9 +1,5 @@
 package main
 
-import (
-	"fmt"
-)
-
 // MarshalBinary converts palette entries to byte slice.
 func (v Palette) MarshalBinary() (data []byte, err error) {
 	data = make([]byte, 3*len(v))
@@ -18,7 +14,7 @@ func (v Palette) MarshalBinary() (data []byte, err error) {
 // UnmarshalBinary converts byte slice to palette entries.
 func (v Palette) UnmarshalBinary(data []byte) error {
 	if len(v)*3 != len(data) {
-		return fmt.Errorf("Len is not valid. required: %d, actual: %d", len(v)*3, len(data))
+		return formatError("Len is not valid. required: %d, actual: %d", len(v)*3, len(data))
 	}
 	for i := 0; i < len(v); i++ {
 		v[i].r = data[i*3]
@@ -39,22 +35,40 @@ type Rgb struct {
 type Palette []Rgb
 
 // ImageFrame holds picture data.
+// If source is set, the frame replaces the pixels below it instead of being
+// drawn over them, as APNG_BLEND_OP_SOURCE does.
 type ImageFrame struct {
 	width             int
 	height            int
 	xOffset           int
 	yOffset           int
 	delay             int
+	disposal          int
 	palette           Palette
 	transparencyIndex int
+	source            bool
 	data              []byte
 }
 
+// extension holds an extension block with an unknown label as raw sub-blocks.
+// frame is the index of the frame which follows it.
+type extension struct {
+	label  byte
+	blocks [][]byte
+	frame  int
+}
+
 // ImageData holds picture frames.
+// If truecolor is set, the frame data holds RGBA pixels instead of palette indices.
+// loopCount is the number of times the animation plays. Zero means forever.
 type ImageData struct {
 	width             int
 	height            int
 	palette           Palette
 	transparencyIndex int
+	backgroundIndex   int
 	frames            []ImageFrame
+	extensions        []extension
+	truecolor         bool
+	loopCount         int
 }
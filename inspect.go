@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type colorTableInfo struct {
+	Offset int64    `json:"offset"`
+	Colors []string `json:"colors"`
+}
+
+type imageDataInfo struct {
+	LZWMinimumCodeSize byte  `json:"lzwMinimumCodeSize"`
+	SubBlocks          int   `json:"subBlocks"`
+	CompressedBytes    int64 `json:"compressedBytes"`
+}
+
+type extensionInfo struct {
+	Label     byte   `json:"label"`
+	SubBlocks int    `json:"subBlocks"`
+	Bytes     int64  `json:"bytes"`
+	Text      string `json:"text,omitempty"`
+}
+
+type blockInfo struct {
+	Type       string          `json:"type"`
+	Offset     int64           `json:"offset"`
+	Length     int64           `json:"length"`
+	Frame      int             `json:"frame"`
+	Fields     fmt.Stringer    `json:"fields,omitempty"`
+	ColorTable *colorTableInfo `json:"colorTable,omitempty"`
+	ImageData  *imageDataInfo  `json:"imageData,omitempty"`
+}
+
+type gifInfo struct {
+	Blocks []blockInfo `json:"blocks"`
+	Error  string      `json:"error,omitempty"`
+}
+
+func (v *applicationExtension) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ApplicationIdentifier         string
+		ApplicationAuthenticationCode string
+	}{
+		string(v.ApplicationIdentifier[:]),
+		string(v.ApplicationAuthenticationCode[:]),
+	})
+}
+
+func (v *extensionInfo) String() string {
+	s := fmt.Sprintf(`
+		Label: 0x%02x
+		SubBlocks: %d
+		Bytes: %d`,
+		v.Label,
+		v.SubBlocks,
+		v.Bytes)
+	if v.Text != "" {
+		s += fmt.Sprintf("\n\t\tText: %q", v.Text)
+	}
+	return s
+}
+
+func newColorTableInfo(offset int64, table []byte) *colorTableInfo {
+	c := colorTableInfo{Offset: offset, Colors: make([]string, len(table)/3)}
+	for i := range c.Colors {
+		c.Colors[i] = fmt.Sprintf("#%02x%02x%02x", table[i*3], table[i*3+1], table[i*3+2])
+	}
+	return &c
+}
+
+func readSubBlockInfo(r io.Reader, keepText bool) (blocks int, bytes int64, text string, err error) {
+	var (
+		buf [255]byte
+		sb  strings.Builder
+	)
+	for {
+		size, err := readByte(r)
+		if err != nil {
+			return 0, 0, "", err
+		}
+		if size == 0 {
+			return blocks, bytes, sb.String(), nil
+		}
+		_, err = io.ReadFull(r, buf[:size])
+		if err != nil {
+			return 0, 0, "", err
+		}
+		if keepText {
+			sb.Write(buf[:size])
+		}
+		blocks++
+		bytes += int64(size)
+	}
+}
+
+// inspectGif walks every block of a GIF stream without decoding the image data.
+// The blocks read before a failure are returned along with the error.
+func inspectGif(r io.Reader) (*gifInfo, error) {
+	var info gifInfo
+	cr := &countingReader{r: r}
+	frame := 0
+	var pos ErrorPosition
+
+	add := func(b blockInfo) {
+		b.Length = cr.n - b.Offset
+		b.Frame = frame
+		info.Blocks = append(info.Blocks, b)
+	}
+	fail := func(err error) (*gifInfo, error) {
+		err = withPosition(err, cr, pos)
+		info.Error = err.Error()
+		return &info, err
+	}
+
+	pos.moveTo("Header", cr, frame)
+	h, err := readHeadser(cr)
+	if err != nil {
+		return fail(err)
+	}
+	add(blockInfo{Type: pos.Block, Offset: pos.Offset, Fields: h})
+
+	pos.moveTo("Logical Screen Descriptor", cr, frame)
+	l, err := readLogicalScreenDescriptor(cr)
+	if err != nil {
+		return fail(err)
+	}
+	b := blockInfo{Type: pos.Block, Offset: pos.Offset, Fields: l}
+	if l.GlobalColorTableFlag {
+		b.ColorTable = newColorTableInfo(pos.Offset+logicalScreenDescriptorSize, l.GlobalColorTable)
+	}
+	add(b)
+
+	for {
+		pos.moveTo("Block Introducer", cr, frame)
+		c, err := readByte(cr)
+		if err != nil {
+			return fail(err)
+		}
+
+		switch c {
+		case 0x2C:
+			pos.Block = "Image Descriptor"
+			i, err := readImageDescriptor(cr)
+			if err != nil {
+				return fail(err)
+			}
+			b := blockInfo{Type: pos.Block, Offset: pos.Offset, Fields: i}
+			if i.LocalColorTableFlag {
+				b.ColorTable = newColorTableInfo(pos.Offset+1+imageDescriptorSize, i.LocalColorTable)
+			}
+			add(b)
+
+			pos.moveTo("Image Data", cr, frame)
+			var d imageDataInfo
+			d.LZWMinimumCodeSize, err = readByte(cr)
+			if err != nil {
+				return fail(err)
+			}
+			d.SubBlocks, d.CompressedBytes, _, err = readSubBlockInfo(cr, false)
+			if err != nil {
+				return fail(err)
+			}
+			add(blockInfo{Type: pos.Block, Offset: pos.Offset, ImageData: &d})
+			frame++
+		case 0x21:
+			pos.Block = "Extension"
+			label, err := readByte(cr)
+			if err != nil {
+				return fail(err)
+			}
+			pos.Block = extensionName(label)
+
+			var fields fmt.Stringer
+			switch label {
+			case 0xF9:
+				fields, err = readGraphicControlExtension(cr)
+			case 0xFF:
+				var a *applicationExtension
+				a, err = readApplicationExtension(cr, new(int64), 0)
+				if a != nil {
+					fields = a
+				}
+			default:
+				e := extensionInfo{Label: label}
+				e.SubBlocks, e.Bytes, e.Text, err = readSubBlockInfo(cr, label == 0xFE)
+				fields = &e
+			}
+			if err != nil {
+				return fail(err)
+			}
+			add(blockInfo{Type: pos.Block, Offset: pos.Offset, Fields: fields})
+		case 0x3b:
+			add(blockInfo{Type: "Trailer", Offset: pos.Offset})
+			return &info, nil
+		default:
+			return fail(formatError("Unknown code: 0x%02x", c))
+		}
+	}
+}
+
+// writeTree writes the blocks as an indented, human readable tree.
+func (v *gifInfo) writeTree(w io.Writer) error {
+	frame := -1
+	for _, b := range v.Blocks {
+		indent := ""
+		switch b.Type {
+		case "Image Descriptor", "Image Data", "Graphic Control Extension":
+			indent = "\t"
+			if b.Frame != frame {
+				frame = b.Frame
+				if _, err := fmt.Fprintf(w, "Frame %d\n", frame); err != nil {
+					return err
+				}
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s%s at %d (%d bytes)", indent, b.Type, b.Offset, b.Length); err != nil {
+			return err
+		}
+		if b.Fields != nil {
+			s := strings.ReplaceAll(b.Fields.String(), "\n\t\t", "\n"+indent+"\t")
+			if !strings.HasPrefix(s, "\n") {
+				s = ": " + s
+			}
+			if _, err := io.WriteString(w, s); err != nil {
+				return err
+			}
+		}
+		if b.ColorTable != nil {
+			if _, err := fmt.Fprintf(w, "\n%s\tColorTable: %d colors at %d", indent, len(b.ColorTable.Colors), b.ColorTable.Offset); err != nil {
+				return err
+			}
+		}
+		if d := b.ImageData; d != nil {
+			if _, err := fmt.Fprintf(w, "\n%s\tLZWMinimumCodeSize: %d\n%s\tSubBlocks: %d\n%s\tCompressedBytes: %d",
+				indent, d.LZWMinimumCodeSize, indent, d.SubBlocks, indent, d.CompressedBytes); err != nil {
+				return err
+			}
+		}
+		if _, err := io.WriteString(w, "\n"); err != nil {
+			return err
+		}
+	}
+	if v.Error != "" {
+		if _, err := fmt.Fprintf(w, "Error: %s\n", v.Error); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+// inspectStream returns a GIF with every kind of block inspect reports, and the
+// offsets of the blocks after the logical screen descriptor.
+func inspectStream() ([]byte, []int) {
+	var b gifBuilder
+	var offsets []int
+	mark := func() { offsets = append(offsets, b.Len()) }
+	b.header("89a")
+	b.screen(4, 4, colorTable(4, 1), 0)
+	mark()
+	b.loop(2)
+	mark()
+	b.control(2, 10, 3)
+	mark()
+	b.image(0, 0, 4, 4, nil, false, 2, pattern(4, 4, 4, 0))
+	mark()
+	b.extension(0xFE, []byte("hi"))
+	mark()
+	b.image(1, 1, 2, 2, colorTable(2, 3), true, 2, pattern(2, 2, 2, 1))
+	mark()
+	b.trailer()
+	return b.Bytes(), offsets
+}
+
+func TestInspect(t *testing.T) {
+	stream, offsets := inspectStream()
+	info, err := inspectGif(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		Blocks []struct {
+			Type       string
+			Offset     int
+			Length     int
+			Frame      int
+			Fields     map[string]any
+			ColorTable *struct {
+				Offset int
+				Colors []string
+			}
+			ImageData *struct {
+				LZWMinimumCodeSize int
+			}
+		}
+	}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		typ    string
+		offset int
+		frame  int
+	}{
+		{"Header", 0, 0},
+		{"Logical Screen Descriptor", 6, 0},
+		{"Application Extension", offsets[0], 0},
+		{"Graphic Control Extension", offsets[1], 0},
+		{"Image Descriptor", offsets[2], 0},
+		{"Image Data", offsets[2] + 10, 0},
+		{"Comment Extension", offsets[3], 1},
+		{"Image Descriptor", offsets[4], 1},
+		{"Image Data", offsets[4] + 10 + 6, 1},
+		{"Trailer", offsets[5], 2},
+	}
+	if len(decoded.Blocks) != len(want) {
+		t.Fatalf("%d blocks, want %d", len(decoded.Blocks), len(want))
+	}
+	end := 0
+	for i, block := range decoded.Blocks {
+		if block.Type != want[i].typ || block.Offset != want[i].offset || block.Frame != want[i].frame {
+			t.Errorf("block %d: %s at %d in frame %d, want %+v", i, block.Type, block.Offset, block.Frame, want[i])
+		}
+		if block.Offset != end {
+			t.Errorf("block %d: offset %d, previous block ends at %d", i, block.Offset, end)
+		}
+		end = block.Offset + block.Length
+	}
+	if end != len(stream) {
+		t.Errorf("blocks end at %d of %d bytes", end, len(stream))
+	}
+
+	if c := decoded.Blocks[1].ColorTable; c == nil || c.Offset != 13 || len(c.Colors) != 4 {
+		t.Errorf("global color table: %+v", c)
+	}
+	if c := decoded.Blocks[7].ColorTable; c == nil || c.Offset != offsets[4]+10 || len(c.Colors) != 2 {
+		t.Errorf("local color table: %+v", c)
+	}
+	if f := decoded.Blocks[3].Fields; f["DelayTime"] != 10.0 || f["TransparentColorIndex"] != 3.0 {
+		t.Errorf("graphic control fields: %v", f)
+	}
+	if f := decoded.Blocks[6].Fields; f["label"] != float64(0xFE) || f["text"] != "hi" {
+		t.Errorf("comment fields: %v", f)
+	}
+	if d := decoded.Blocks[5].ImageData; d == nil || d.LZWMinimumCodeSize != 2 {
+		t.Errorf("image data: %+v", d)
+	}
+}
+
+// TestInspectCorpus checks that the blocks of every corpus stream are contiguous
+// and cover the whole stream.
+func TestInspectCorpus(t *testing.T) {
+	for _, c := range corpus {
+		stream := c.gif()
+		info, err := inspectGif(bytes.NewReader(stream))
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		end := int64(0)
+		for _, block := range info.Blocks {
+			if block.Offset != end {
+				t.Errorf("%s: %s at %d, previous block ends at %d", c.name, block.Type, block.Offset, end)
+			}
+			end = block.Offset + block.Length
+		}
+		if end != int64(len(stream)) {
+			t.Errorf("%s: blocks end at %d of %d bytes", c.name, end, len(stream))
+		}
+	}
+}
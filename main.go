@@ -1,15 +1,71 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"flag"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 func changeExt(path string, ext string) string {
 	return path[:len(path)-len(filepath.Ext(path))] + ext
 }
 
+func isWebp(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".webp")
+}
+
+func isIcon(path string) bool {
+	ext := filepath.Ext(path)
+	return strings.EqualFold(ext, ".ico") || strings.EqualFold(ext, ".cur")
+}
+
+// intList is a comma separated list of integers as a flag.Value.
+type intList []int
+
+func (v intList) String() string {
+	s := make([]string, len(v))
+	for i, n := range v {
+		s[i] = strconv.Itoa(n)
+	}
+	return strings.Join(s, ",")
+}
+
+func (v *intList) Set(s string) error {
+	*v = nil
+	for _, field := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return err
+		}
+		*v = append(*v, n)
+	}
+	return nil
+}
+
+// speedFactor is a playback speed multiplier as a flag.Value, which must be positive.
+type speedFactor float64
+
+func (v *speedFactor) String() string {
+	return strconv.FormatFloat(float64(*v), 'g', -1, 64)
+}
+
+func (v *speedFactor) Set(s string) error {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	if f <= 0 {
+		return errors.New("Speed must be positive")
+	}
+	*v = speedFactor(f)
+	return nil
+}
+
 func readFile(path string) (*ImageData, error) {
 	in, err := os.Open(path)
 	if err != nil {
@@ -19,28 +75,326 @@ func readFile(path string) (*ImageData, error) {
 	return ReadGif(in, true)
 }
 
-func writeFile(path string, data *ImageData) error {
+// writeFile writes WebP if path ends with .webp, and PNG otherwise.
+func writeFile(path string, data *ImageData, opts *EncodeOptions) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if isWebp(path) {
+		return WriteWebpWithOptions(out, data, opts)
+	}
+	if opts.Optimize {
+		chosen, err := OptimizePng(out, data, opts)
+		if err != nil {
+			return err
+		}
+		log.Printf("Optimize: color %v, bit depth %d, filter %v, compression %v",
+			chosen.ColorMode, chosen.BitDepth, chosen.Filter, chosen.Compression)
+		return nil
+	}
+	return WritePngWithOptions(out, data, opts)
+}
+
+// writeSheetFile writes the sprite sheet to path and its atlas next to it with
+// extension .json.
+func writeSheetFile(path string, data *ImageData, sheet *SheetOptions, opts *EncodeOptions) error {
 	out, err := os.Create(path)
 	if err != nil {
 		return err
 	}
 	defer out.Close()
-	return WritePng(out, data)
+	atlas, err := os.Create(changeExt(path, ".json"))
+	if err != nil {
+		return err
+	}
+	defer atlas.Close()
+	sheet.ImageName = filepath.Base(path)
+	return WriteSpriteSheet(out, atlas, data, sheet, opts)
+}
+
+// writeIconFile writes an icon, or a cursor if path ends with .cur.
+func writeIconFile(path string, data *ImageData, icon *IconOptions, opts *EncodeOptions) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	icon.Cursor = strings.EqualFold(filepath.Ext(path), ".cur")
+	return WriteIco(out, data, icon, opts)
+}
+
+func readPngFile(path string) (*ImageData, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	return ReadPng(in)
+}
+
+func writeGifFile(path string, data *ImageData) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return WriteGif(out, data)
+}
+
+func png2gifFile(args []string) error {
+	fs := flag.NewFlagSet("png2gif", flag.ExitOnError)
+	fs.Parse(args)
+	src := fs.Arg(0)
+	if src == "" {
+		src = "test.png"
+	}
+
+	data, err := readPngFile(src)
+	if err != nil {
+		return err
+	}
+	return writeGifFile(changeExt(src, ".gif"), data)
+}
+
+func contactFile(args []string) error {
+	fs := flag.NewFlagSet("contact", flag.ExitOnError)
+	var contact ContactOptions
+	fs.IntVar(&contact.Every, "every", 1, "show every Nth frame")
+	fs.IntVar(&contact.Columns, "columns", 0, "number of thumbnails per row, 0 for about square")
+	fs.IntVar(&contact.ThumbWidth, "width", 160, "maximum thumbnail width")
+	fs.IntVar(&contact.ThumbHeight, "height", 160, "maximum thumbnail height")
+	out := fs.String("o", "", "output file, the source with extension .contact.png by default")
+	fs.Parse(args)
+	src := fs.Arg(0)
+	if src == "" {
+		src = "test.gif"
+	}
+
+	data, err := readFile(src)
+	if err != nil {
+		return err
+	}
+	dst := *out
+	if dst == "" {
+		dst = changeExt(src, ".contact.png")
+	}
+	w, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	return WriteContactSheet(w, data, &contact, nil)
+}
+
+func rawFile(args []string) error {
+	fs := flag.NewFlagSet("raw", flag.ExitOnError)
+	var raw RawOptions
+	var opts EncodeOptions
+	fs.Var(&raw.Format, "format", "stream format: y4m or pam")
+	fs.Var(&raw.Rate, "fps", "constant frame rate of the stream, such as 25 or 30000/1001")
+	fs.Var(&opts.DelayPolicy, "delay-policy", "frame delay policy: preserve, browser or min")
+	fs.IntVar(&opts.MinDelay, "min-delay", 2, "minimum frame delay in centiseconds for -delay-policy=min")
+	opts.Speed = 1
+	fs.Var((*speedFactor)(&opts.Speed), "speed", "playback speed multiplier")
+	fs.Parse(args)
+	src := fs.Arg(0)
+	if src == "" {
+		src = "test.gif"
+	}
+
+	data, err := readFile(src)
+	if err != nil {
+		return err
+	}
+	return WriteRawFrames(os.Stdout, data, &raw, &opts)
+}
+
+// verifyFile compares the PNG written to dst with the GIF src, transformed the same way.
+func verifyFile(src, dst string, transform func(*ImageData) error, opts *EncodeOptions) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	want, err := ReadGifReference(in)
+	if err != nil {
+		return err
+	}
+	if err := transform(want); err != nil {
+		return err
+	}
+
+	out, err := os.Open(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if err := VerifyPng(out, want, opts); err != nil {
+		return err
+	}
+	log.Printf("Verified %s: %d frames", dst, len(want.frames))
+	return nil
+}
+
+func inspectFile(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "write JSON instead of a tree")
+	fs.Parse(args)
+	src := fs.Arg(0)
+	if src == "" {
+		src = "test.gif"
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := inspectGif(in)
+	if *asJSON {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		if werr := e.Encode(info); werr != nil {
+			return werr
+		}
+	} else if werr := info.writeTree(os.Stdout); werr != nil {
+		return werr
+	}
+	return err
 }
 
 func main() {
-	var src string
-	if len(os.Args) > 1 {
-		src = os.Args[1]
-	} else {
+	if len(os.Args) > 1 && os.Args[1] == "inspect" {
+		if err := inspectFile(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "contact" {
+		if err := contactFile(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "raw" {
+		if err := rawFile(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "png2gif" {
+		if err := png2gifFile(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	var opts EncodeOptions
+	flag.BoolVar(&opts.OptimizeFrames, "optimize-frames", false, "store only the changed rectangle of each animation frame")
+	flag.BoolVar(&opts.MergeDuplicateFrames, "merge-frames", false, "merge identical consecutive frames and sum their delays")
+	flag.Var(&opts.DelayPolicy, "delay-policy", "frame delay policy: preserve, browser or min")
+	flag.IntVar(&opts.MinDelay, "min-delay", 2, "minimum frame delay in centiseconds for -delay-policy=min")
+	opts.Speed = 1
+	flag.Var((*speedFactor)(&opts.Speed), "speed", "playback speed multiplier")
+	flag.Var(&opts.ColorMode, "color", "PNG color type: auto, palette, rgb or rgba")
+	flag.Var(&opts.Poster, "poster", "default image outside the animation: frame index, middle or colorful")
+	flag.IntVar(&opts.BitDepth, "bit-depth", 0, "bit depth of palette output: 1, 2, 4 or 8")
+	flag.Var(&opts.Filter, "filter", "scanline filter: none, sub, up, average, paeth or adaptive")
+	flag.Var(&opts.Compression, "compression", "zlib level: best, default, fast or none")
+	flag.IntVar(&opts.Workers, "workers", 0, "number of goroutines compressing frames, 0 for one per CPU")
+	flag.IntVar(&opts.MaxChunkSize, "max-chunk-size", 0, "maximum data length of IDAT and fdAT chunks, 0 for no limit")
+	flag.BoolVar(&opts.Optimize, "optimize", false, "try color modes, bit depths, filters and compression levels and keep the smallest output")
+	reverse := flag.Bool("reverse", false, "play the animation backwards")
+	pingPong := flag.Bool("pingpong", false, "play the animation forwards and then backwards")
+	trimStart := flag.Duration("trim-start", 0, "drop the part of the animation before this time")
+	trimEnd := flag.Duration("trim-end", 0, "drop the part of the animation after this time")
+	verify := flag.Bool("verify", false, "decode the output and compare it with the source decoded by image/gif")
+	var sheet SheetOptions
+	flag.Var(&sheet.Layout, "sheet", "write a sprite sheet PNG and JSON atlas instead of an animation: none, grid or packed")
+	flag.IntVar(&sheet.Columns, "sheet-columns", 0, "number of columns of -sheet=grid, 0 for about square")
+	flag.IntVar(&sheet.Padding, "sheet-padding", 0, "transparent pixels between the frames of a sprite sheet")
+	var icon IconOptions
+	var hotspot intList
+	flag.Var((*intList)(&icon.Sizes), "icon-sizes", "comma separated square sizes of .ico and .cur images, the screen size scaled to fit 256 by default")
+	flag.Var((*intList)(&icon.Frames), "icon-frames", "comma separated frames of .ico and .cur images: one, or one per size")
+	flag.Var(&hotspot, "hotspot", "x,y of the .cur hotspot on the logical screen")
+	out := flag.String("o", "", "output file, the source with extension .png by default; .webp writes lossless WebP, .ico and .cur an icon or cursor")
+	flag.Parse()
+
+	src := flag.Arg(0)
+	if src == "" {
 		src = "test.gif"
 	}
 	data, err := readFile(src)
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = writeFile(changeExt(src, ".png"), data)
+	transform := func(data *ImageData) error {
+		if *trimStart > 0 || *trimEnd > 0 {
+			if err := data.Trim(*trimStart, *trimEnd); err != nil {
+				return err
+			}
+		}
+		if *reverse {
+			data.Reverse()
+		}
+		if *pingPong {
+			data.PingPong()
+		}
+		return nil
+	}
+	if err := transform(data); err != nil {
+		log.Fatal(err)
+	}
+	dst := *out
+	if dst == "" {
+		dst = changeExt(src, ".png")
+	}
+	if *verify && isWebp(dst) {
+		log.Fatal(&UnsupportedError{Feature: "verifying WebP output"})
+	}
+	if opts.Optimize && (isWebp(dst) || isIcon(dst)) {
+		log.Fatal(&UnsupportedError{Feature: "-optimize with WebP, .ico or .cur output"})
+	}
+	if len(hotspot) > 0 && !strings.EqualFold(filepath.Ext(dst), ".cur") {
+		log.Fatal(&UnsupportedError{Feature: "-hotspot without .cur output"})
+	}
+	if isIcon(dst) {
+		if *verify {
+			log.Fatal(&UnsupportedError{Feature: "verifying icons"})
+		}
+		if sheet.Layout != SheetNone {
+			log.Fatal(&UnsupportedError{Feature: "sprite sheets with .ico or .cur output"})
+		}
+		if len(hotspot) > 0 {
+			if len(hotspot) != 2 {
+				log.Fatalf("Hotspot needs x,y: %v", hotspot)
+			}
+			icon.HotspotX, icon.HotspotY = hotspot[0], hotspot[1]
+		}
+		if err := writeIconFile(dst, data, &icon, &opts); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if sheet.Layout != SheetNone {
+		if *verify || isWebp(dst) {
+			log.Fatal(&UnsupportedError{Feature: "sprite sheets with -verify or WebP output"})
+		}
+		if err := writeSheetFile(dst, data, &sheet, &opts); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	err = writeFile(dst, data, &opts)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if *verify {
+		if err := verifyFile(src, dst, transform, &opts); err != nil {
+			log.Fatal(err)
+		}
+	}
 }
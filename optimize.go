@@ -0,0 +1,199 @@
+package main
+
+// apngFrame is a frame as written to fcTL and IDAT/fdAT.
+type apngFrame struct {
+	ImageFrame
+	disposeOp byte
+	blendOp   byte
+}
+
+// cleared marks a pixel of a base canvas which is fully transparent black
+// after APNG_DISPOSE_OP_BACKGROUND.
+const cleared = -1
+
+// canvasFormat tells how the optimizer compares and writes pixels.
+// transparent is nil if the output format can not express transparency.
+type canvasFormat struct {
+	ps          int
+	transparent []byte
+}
+
+func newCanvasFormat(data *ImageData, format pngFormat) canvasFormat {
+	switch {
+	case data.truecolor && format.hasAlpha():
+		return canvasFormat{4, []byte{0, 0, 0, 0}}
+	case data.truecolor:
+		return canvasFormat{4, nil}
+	case data.transparencyIndex != -1:
+		return canvasFormat{1, []byte{byte(data.transparencyIndex)}}
+	}
+	return canvasFormat{1, nil}
+}
+
+// key maps a pixel to a comparable value. All transparent RGBA pixels share key 0.
+func (v canvasFormat) key(p []byte) int64 {
+	if v.ps == 1 {
+		return int64(p[0])
+	}
+	if p[3] == 0 {
+		return 0
+	}
+	return int64(p[0])<<24 | int64(p[1])<<16 | int64(p[2])<<8 | int64(p[3])
+}
+
+func (v canvasFormat) transparentKey() int64 {
+	if v.transparent == nil {
+		return cleared - 1
+	}
+	return v.key(v.transparent)
+}
+
+func (v canvasFormat) opaque(p []byte) bool {
+	if v.ps == 1 {
+		return v.key(p) != v.transparentKey()
+	}
+	return p[3] == 255
+}
+
+type rect struct {
+	x0, y0, x1, y1 int
+}
+
+func (v rect) empty() bool {
+	return v.x0 >= v.x1 || v.y0 >= v.y1
+}
+
+func samePixel(base int64, target int64, transparentKey int64) bool {
+	if base == cleared {
+		return target == transparentKey
+	}
+	return base == target
+}
+
+func changedRect(base []int64, target *ImageFrame, cf canvasFormat) rect {
+	tk := cf.transparentKey()
+	r := rect{target.width, target.height, 0, 0}
+	for y := 0; y < target.height; y++ {
+		for x := 0; x < target.width; x++ {
+			p := y*target.width + x
+			if samePixel(base[p], cf.key(target.data[p*cf.ps:(p+1)*cf.ps]), tk) {
+				continue
+			}
+			r.x0 = min(r.x0, x)
+			r.y0 = min(r.y0, y)
+			r.x1 = max(r.x1, x+1)
+			r.y1 = max(r.y1, y+1)
+		}
+	}
+	return r
+}
+
+// cropFrame cuts r out of target. With blendOp over, pixels equal to base become
+// transparent; it fails if a pixel which is not opaque has to be drawn on an opaque base.
+func cropFrame(base []int64, target *ImageFrame, r rect, blendOp byte, cf canvasFormat) (*ImageFrame, bool) {
+	f := ImageFrame{
+		width:             r.x1 - r.x0,
+		height:            r.y1 - r.y0,
+		xOffset:           r.x0,
+		yOffset:           r.y0,
+		delay:             target.delay,
+		transparencyIndex: target.transparencyIndex,
+	}
+	tk := cf.transparentKey()
+	f.data = make([]byte, 0, f.width*f.height*cf.ps)
+	for y := r.y0; y < r.y1; y++ {
+		for x := r.x0; x < r.x1; x++ {
+			p := y*target.width + x
+			c := target.data[p*cf.ps : (p+1)*cf.ps]
+			if blendOp == blendOpOver {
+				if samePixel(base[p], cf.key(c), tk) {
+					c = cf.transparent
+				} else if base[p] != cleared && !cf.opaque(c) {
+					return nil, false
+				}
+			}
+			f.data = append(f.data, c...)
+		}
+	}
+	return &f, true
+}
+
+func compressedSize(frame *ImageFrame, format pngFormat) int {
+	var n countingWriter
+	writeData(&n, serialize(frame, format), format.level)
+	return int(n)
+}
+
+type countingWriter int
+
+func (v *countingWriter) Write(p []byte) (int, error) {
+	*v += countingWriter(len(p))
+	return len(p), nil
+}
+
+func baseCanvas(prev []int64, prevFrame *apngFrame, composited *ImageFrame, cf canvasFormat, disposeOp byte) []int64 {
+	base := make([]int64, composited.width*composited.height)
+	if disposeOp == disposeOpPrevious {
+		copy(base, prev)
+		return base
+	}
+	for i := range base {
+		base[i] = cf.key(composited.data[i*cf.ps : (i+1)*cf.ps])
+	}
+	if disposeOp == disposeOpBackground {
+		for y := prevFrame.yOffset; y < prevFrame.yOffset+prevFrame.height; y++ {
+			for x := prevFrame.xOffset; x < prevFrame.xOffset+prevFrame.width; x++ {
+				base[y*composited.width+x] = cleared
+			}
+		}
+	}
+	return base
+}
+
+// optimizeFrames reduces every composited frame after the first one to the
+// rectangle which differs from the canvas left by its predecessor.
+// The dispose op of the predecessor and the blend op are chosen to minimize the
+// compressed size.
+func optimizeFrames(data *ImageData, composited []ImageFrame, format pngFormat) []apngFrame {
+	cf := newCanvasFormat(data, format)
+	frames := make([]apngFrame, len(composited))
+	frames[0] = apngFrame{ImageFrame: composited[0], disposeOp: disposeOpNone, blendOp: blendOpSource}
+
+	// prev is the canvas the previous frame was drawn onto.
+	prev := make([]int64, data.width*data.height)
+	for i := range prev {
+		prev[i] = cleared
+	}
+	for i := 1; i < len(composited); i++ {
+		var (
+			best     *ImageFrame
+			bestBase []int64
+			bestSize int
+		)
+		for _, disposeOp := range []byte{disposeOpNone, disposeOpBackground, disposeOpPrevious} {
+			base := baseCanvas(prev, &frames[i-1], &composited[i-1], cf, disposeOp)
+			r := changedRect(base, &composited[i], cf)
+			if r.empty() {
+				r = rect{0, 0, 1, 1}
+			}
+			for _, blendOp := range []byte{blendOpSource, blendOpOver} {
+				if blendOp == blendOpOver && cf.transparent == nil {
+					continue
+				}
+				f, ok := cropFrame(base, &composited[i], r, blendOp, cf)
+				if !ok {
+					continue
+				}
+				size := compressedSize(f, format)
+				if best == nil || size < bestSize {
+					best, bestBase, bestSize = f, base, size
+					frames[i-1].disposeOp = disposeOp
+					frames[i].blendOp = blendOp
+				}
+			}
+		}
+		frames[i].ImageFrame = *best
+		prev = bestBase
+	}
+	return frames
+}
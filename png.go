@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"compress/zlib"
 	"encoding/binary"
+	"fmt"
 	"hash/crc32"
 	"io"
+	"runtime"
+	"sync"
 )
 
 const (
@@ -31,6 +34,60 @@ const (
 	adam7Interlace
 )
 
+const (
+	disposeOpNone = iota
+	disposeOpBackground
+	disposeOpPrevious
+)
+
+const (
+	blendOpSource = iota
+	blendOpOver
+)
+
+// EncodeOptions configures WritePngWithOptions.
+type EncodeOptions struct {
+	// OptimizeFrames composites the animation frames and stores only the changed
+	// rectangle of each one.
+	OptimizeFrames bool
+
+	// MergeDuplicateFrames merges frames which look the same as their predecessor
+	// after compositing into one frame showing for their total delay.
+	MergeDuplicateFrames bool
+
+	// DelayPolicy and MinDelay, in centiseconds, normalize the frame delays.
+	DelayPolicy DelayPolicy
+	MinDelay    int
+
+	// Speed multiplies the playback speed. Zero means 1.
+	Speed float64
+
+	// Poster selects a default image shown by viewers without APNG support.
+	Poster Poster
+
+	// ColorMode selects palette or truecolor output.
+	ColorMode ColorMode
+
+	// BitDepth is the bit depth of palette output: 1, 2, 4 or 8. Zero means 8.
+	BitDepth int
+
+	// Filter selects the scanline filters and Compression the zlib level.
+	Filter      FilterStrategy
+	Compression CompressionLevel
+
+	// Workers is the number of goroutines compressing animation frames.
+	// Zero means one per CPU.
+	Workers int
+
+	// MaxChunkSize limits the data length of each IDAT and fdAT chunk.
+	// Image data is split across as many chunks as needed. Zero means no limit.
+	MaxChunkSize int
+
+	// Optimize encodes candidates across color mode, bit depth, filter and
+	// compression level and writes the smallest. See OptimizePng.
+	Optimize bool
+}
+
 type imageHeader struct {
 	Width             uint32
 	Height            uint32
@@ -105,12 +162,12 @@ func writeChunk(w io.Writer, chunkType string, data []byte) error {
 	return nil
 }
 
-func writeIHDR(w io.Writer, data *ImageData) error {
+func writeIHDR(w io.Writer, frame *ImageFrame, format pngFormat) error {
 	b, _ := imageHeader{
-		Width:             uint32(data.frames[0].width),
-		Height:            uint32(data.frames[0].height),
-		BitDepth:          8,
-		ColorType:         paletteUsed | trueColorUsed,
+		Width:             uint32(frame.width),
+		Height:            uint32(frame.height),
+		BitDepth:          format.bitDepth,
+		ColorType:         format.colorType,
 		CompressionMethod: deflateCompression,
 		FilterMethod:      noneFilter,
 		InterlaceMethod:   noInterlace,
@@ -133,27 +190,54 @@ func writeTRNS(w io.Writer, entries int, transparencyIndex int) error {
 	return writeChunk(w, "tRNS", b[:entries])
 }
 
-func serialize(frame *ImageFrame) []byte {
-	b := make([]byte, 0, (frame.width+1)*frame.height)
+func writeGrayTRNS(w io.Writer, format pngFormat) error {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], uint16(format.gray[format.transparencyIndex]))
+	return writeChunk(w, "tRNS", b[:])
+}
+
+func serialize(frame *ImageFrame, format pngFormat) []byte {
+	ps := len(frame.data) / max(frame.width*frame.height, 1)
+	b := make([]byte, 0, (frame.width*ps+1)*frame.height)
 	for i := 0; i < frame.height; i++ {
 		b = append(b, 0)
-		b = append(b, frame.data[frame.width*i:frame.width*(i+1)]...)
+		row := frame.data[frame.width*ps*i : frame.width*ps*(i+1)]
+		if format.gray != nil {
+			b = format.appendGrayRow(b, row)
+			continue
+		}
+		if format.bitDepth < 8 {
+			b = packSamples(b, row, format.bitDepth, nil)
+			continue
+		}
+		if format.colorType == trueColorUsed {
+			for j := 0; j < len(row); j += ps {
+				b = format.appendPixel(b, row[j:j+ps])
+			}
+			continue
+		}
+		b = append(b, row...)
+	}
+	if frame.height > 0 {
+		applyFilter(b, len(b)/frame.height-1, format.bytesPerPixel(), format.filter)
 	}
 	return b
 }
 
-func writeACTL(w io.Writer, data *ImageData) error {
+// writeACTL writes the animation control chunk. num_plays is the loop count of
+// the source, zero meaning forever.
+func writeACTL(w io.Writer, frames []apngFrame, loopCount int) error {
 	var buf [8]byte
 
-	binary.BigEndian.PutUint32(buf[:4], uint32(len(data.frames)))
-	binary.BigEndian.PutUint32(buf[4:], 0)
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(frames)))
+	binary.BigEndian.PutUint32(buf[4:], uint32(loopCount))
 	if err := writeChunk(w, "acTL", buf[:]); err != nil {
 		return err
 	}
 	return nil
 }
 
-func writeFCTL(w io.Writer, frame *ImageFrame, seq int) error {
+func writeFCTL(w io.Writer, frame *apngFrame, seq int, opts *EncodeOptions) error {
 	var f frameControl
 
 	f.SequenceNumber = uint32(seq)
@@ -161,14 +245,9 @@ func writeFCTL(w io.Writer, frame *ImageFrame, seq int) error {
 	f.Height = uint32(frame.height)
 	f.XOffset = uint32(frame.xOffset)
 	f.YOffset = uint32(frame.yOffset)
-	f.DelayNum = uint16(frame.delay)
-	f.DelayDen = 100
-	f.DisposeOp = 0
-	if frame.transparencyIndex == -1 {
-		f.BlendOp = 0
-	} else {
-		f.BlendOp = 1
-	}
+	f.DelayNum, f.DelayDen = opts.frameDelay(frame.delay)
+	f.DisposeOp = frame.disposeOp
+	f.BlendOp = frame.blendOp
 
 	b, _ := f.MarshalBinary()
 	if err := writeChunk(w, "fcTL", b); err != nil {
@@ -177,8 +256,8 @@ func writeFCTL(w io.Writer, frame *ImageFrame, seq int) error {
 	return nil
 }
 
-func writeData(w io.Writer, data []byte) error {
-	zw, err := zlib.NewWriterLevel(w, zlib.BestCompression)
+func writeData(w io.Writer, data []byte, level CompressionLevel) error {
+	zw, err := zlib.NewWriterLevel(w, level.zlibLevel())
 	if err != nil {
 		return err
 	}
@@ -194,63 +273,152 @@ func writeData(w io.Writer, data []byte) error {
 	return nil
 }
 
-func writeIDAT(w io.Writer, data *ImageData) error {
+// compress serializes and compresses the image data of a frame.
+func compress(frame *ImageFrame, format pngFormat) ([]byte, error) {
 	buf := &bytes.Buffer{}
-	err := writeData(buf, serialize(&data.frames[0]))
-	if err != nil {
-		return err
+	if err := writeData(buf, serialize(frame, format), format.level); err != nil {
+		return nil, err
 	}
-	err = writeChunk(w, "IDAT", buf.Bytes())
-	if err != nil {
-		return err
+	return buf.Bytes(), nil
+}
+
+// compressFrames compresses the frames with up to workers goroutines.
+// Zero workers means one per CPU.
+func compressFrames(frames []*ImageFrame, format pngFormat, workers int) ([][]byte, error) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
 	}
-	return nil
+	compressed := make([][]byte, len(frames))
+	errs := make([]error, len(frames))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < min(workers, len(frames)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range next {
+				compressed[j], errs[j] = compress(frames[j], format)
+			}
+		}()
+	}
+	for i := range frames {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return compressed, nil
 }
 
-func writeFDAT(w io.Writer, frame *ImageFrame, seq int) error {
-	var b [4]byte
-	buf := &bytes.Buffer{}
-	binary.BigEndian.PutUint32(b[:], uint32(seq))
-	_, err := buf.Write(b[:])
-	if err != nil {
-		return err
+// splitData cuts compressed image data into pieces of at most size bytes.
+// Zero size means one piece.
+func splitData(compressed []byte, size int) [][]byte {
+	if size <= 0 || len(compressed) <= size {
+		return [][]byte{compressed}
 	}
-	err = writeData(buf, serialize(frame))
-	if err != nil {
-		return err
+	var pieces [][]byte
+	for len(compressed) > size {
+		pieces = append(pieces, compressed[:size])
+		compressed = compressed[size:]
 	}
-	err = writeChunk(w, "fdAT", buf.Bytes())
-	if err != nil {
-		return err
+	return append(pieces, compressed)
+}
+
+func writeIDAT(w io.Writer, compressed []byte, maxChunkSize int) error {
+	for _, b := range splitData(compressed, maxChunkSize) {
+		if err := writeChunk(w, "IDAT", b); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// writeFDAT writes the data in fdAT chunks of at most maxChunkSize bytes
+// numbered from seq, and returns the next sequence number.
+func writeFDAT(w io.Writer, compressed []byte, seq int, maxChunkSize int) (int, error) {
+	size := 0
+	if maxChunkSize > 0 {
+		size = maxChunkSize - 4
+	}
+	for _, piece := range splitData(compressed, size) {
+		b := make([]byte, 4, 4+len(piece))
+		binary.BigEndian.PutUint32(b, uint32(seq))
+		if err := writeChunk(w, "fdAT", append(b, piece...)); err != nil {
+			return seq, err
+		}
+		seq++
+	}
+	return seq, nil
+}
+
 func writeIEND(w io.Writer) error {
 	return writeChunk(w, "IEND", nil)
 }
 
-func writeAnimationPngData(w io.Writer, data *ImageData) error {
-	if err := writeACTL(w, data); err != nil {
-		return err
+func animationFrames(data *ImageData) []apngFrame {
+	frames := make([]apngFrame, len(data.frames))
+	for i, f := range data.frames {
+		frames[i].ImageFrame = f
+		switch f.disposal {
+		case disposalBackground:
+			frames[i].disposeOp = disposeOpBackground
+		case disposalPrevious:
+			frames[i].disposeOp = disposeOpPrevious
+		}
+		if !f.source && (f.transparencyIndex != -1 || data.truecolor) {
+			frames[i].blendOp = blendOpOver
+		}
 	}
-	seq := 0
-	if err := writeFCTL(w, &data.frames[0], seq); err != nil {
+	return frames
+}
+
+// writeAnimationPngData writes the frames following the default image poster.
+// If poster is nil, the first frame is the default image.
+// The frames are compressed concurrently and written in order.
+func writeAnimationPngData(w io.Writer, frames []apngFrame, poster *ImageFrame, loopCount int, format pngFormat, opts *EncodeOptions) error {
+	images := make([]*ImageFrame, 0, len(frames)+1)
+	if poster != nil {
+		images = append(images, poster)
+	}
+	for i := range frames {
+		images = append(images, &frames[i].ImageFrame)
+	}
+	compressed, err := compressFrames(images, format, opts.Workers)
+	if err != nil {
 		return err
 	}
-	seq++
-	if err := writeIDAT(w, data); err != nil {
+
+	if err := writeACTL(w, frames, loopCount); err != nil {
 		return err
 	}
-	for _, f := range data.frames[1:] {
-		if err := writeFCTL(w, &f, seq); err != nil {
+	seq := 0
+	if poster != nil {
+		if err := writeIDAT(w, compressed[0], opts.MaxChunkSize); err != nil {
+			return err
+		}
+		compressed = compressed[1:]
+	} else {
+		if err := writeFCTL(w, &frames[0], seq, opts); err != nil {
 			return err
 		}
 		seq++
-		if err := writeFDAT(w, &f, seq); err != nil {
+		if err := writeIDAT(w, compressed[0], opts.MaxChunkSize); err != nil {
+			return err
+		}
+		frames, compressed = frames[1:], compressed[1:]
+	}
+	for i := range frames {
+		if err := writeFCTL(w, &frames[i], seq, opts); err != nil {
 			return err
 		}
 		seq++
+		if seq, err = writeFDAT(w, compressed[i], seq, opts.MaxChunkSize); err != nil {
+			return err
+		}
 	}
 	if err := writeIEND(w); err != nil {
 		return err
@@ -258,8 +426,12 @@ func writeAnimationPngData(w io.Writer, data *ImageData) error {
 	return nil
 }
 
-func writeNormalPngData(w io.Writer, data *ImageData) error {
-	if err := writeIDAT(w, data); err != nil {
+func writeNormalPngData(w io.Writer, frame *ImageFrame, format pngFormat, opts *EncodeOptions) error {
+	compressed, err := compress(frame, format)
+	if err != nil {
+		return err
+	}
+	if err := writeIDAT(w, compressed, opts.MaxChunkSize); err != nil {
 		return err
 	}
 	if err := writeIEND(w); err != nil {
@@ -270,22 +442,91 @@ func writeNormalPngData(w io.Writer, data *ImageData) error {
 
 // WritePng writes the image data to writer in PNG format.
 func WritePng(w io.Writer, data *ImageData) error {
-	if err := writePngSignature(w); err != nil {
+	return WritePngWithOptions(w, data, nil)
+}
+
+// WritePngWithOptions writes the image data to writer in PNG format as configured by opts.
+func WritePngWithOptions(w io.Writer, data *ImageData, opts *EncodeOptions) error {
+	if opts == nil {
+		opts = &EncodeOptions{}
+	}
+	if opts.MaxChunkSize != 0 && opts.MaxChunkSize <= 4 {
+		return fmt.Errorf("Max chunk size must be more than 4 bytes: %d", opts.MaxChunkSize)
+	}
+	if len(data.frames) == 0 {
+		return fmt.Errorf("No frames to write")
+	}
+	if data.width == 0 || data.height == 0 {
+		return &UnsupportedError{Feature: fmt.Sprintf("image size %dx%d", data.width, data.height)}
+	}
+	if opts.Optimize {
+		_, err := OptimizePng(w, data, opts)
 		return err
 	}
-	if err := writeIHDR(w, data); err != nil {
+	data, format, err := prepareColors(data, opts.ColorMode)
+	if err != nil {
 		return err
 	}
-	if err := writePLTE(w, data); err != nil {
+	if err := format.setPaletteDepth(data, opts.BitDepth); err != nil {
 		return err
 	}
-	if data.transparencyIndex != -1 {
-		if err := writeTRNS(w, len(data.palette), data.transparencyIndex); err != nil {
+	format.filter = opts.Filter
+	format.level = opts.Compression
+
+	// Without alpha, frames can not be drawn over their predecessors.
+	// The first frame defines the size of the image, so it has to cover the canvas,
+	// and the others have to lie within it.
+	coalesce := data.truecolor && !format.hasAlpha()
+	var frames []apngFrame
+	if (len(data.frames) > 1 && (opts.OptimizeFrames || opts.MergeDuplicateFrames || coalesce)) || !coversCanvas(data) || !insideCanvas(data) {
+		composited := compositeFrames(data)
+		if opts.MergeDuplicateFrames {
+			composited = mergeDuplicateFrames(composited)
+		}
+		if opts.OptimizeFrames {
+			frames = optimizeFrames(data, composited, format)
+		} else {
+			frames = make([]apngFrame, len(composited))
+			for i, f := range composited {
+				frames[i].ImageFrame = f
+			}
+		}
+	} else {
+		frames = animationFrames(data)
+	}
+	header := &frames[0].ImageFrame
+	var poster *ImageFrame
+	if len(frames) > 1 && opts.Poster.Mode != PosterNone {
+		poster, err = posterFrame(data, opts.Poster)
+		if err != nil {
+			return err
+		}
+		header = poster
+	}
+
+	if err := writePngSignature(w); err != nil {
+		return err
+	}
+	if err := writeIHDR(w, header, format); err != nil {
+		return err
+	}
+	if format.colorType&paletteUsed != 0 {
+		if err := writePLTE(w, data); err != nil {
+			return err
+		}
+		if data.transparencyIndex != -1 {
+			if err := writeTRNS(w, len(data.palette), data.transparencyIndex); err != nil {
+				return err
+			}
+		}
+	}
+	if format.colorType == 0 && format.transparencyIndex != -1 {
+		if err := writeGrayTRNS(w, format); err != nil {
 			return err
 		}
 	}
-	if len(data.frames) > 1 {
-		return writeAnimationPngData(w, data)
+	if len(frames) > 1 {
+		return writeAnimationPngData(w, frames, poster, data.loopCount, format, opts)
 	}
-	return writeNormalPngData(w, data)
+	return writeNormalPngData(w, &frames[0].ImageFrame, format, opts)
 }
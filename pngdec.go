@@ -0,0 +1,644 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+var pngSignature = []byte{137, 80, 78, 71, 13, 10, 26, 10}
+
+const (
+	imageHeaderSize    = 13
+	animationCtrlSize  = 8
+	frameControlSize   = 26
+	maxPngChunkLength  = 1<<31 - 1
+	pngSequenceNumSize = 4
+
+	// defaultMaxPngPixels bounds the canvas unless DecodeOptions set
+	// MaxCanvasPixels: 1 GiB of RGBA.
+	defaultMaxPngPixels = 1 << 28
+)
+
+func (v *imageHeader) UnmarshalBinary(data []byte) error {
+	if len(data) != imageHeaderSize {
+		return formatError("Len is not valid. required: %d, actual: %d", imageHeaderSize, len(data))
+	}
+	v.Width = binary.BigEndian.Uint32(data[0:4])
+	v.Height = binary.BigEndian.Uint32(data[4:8])
+	v.BitDepth = data[8]
+	v.ColorType = data[9]
+	v.CompressionMethod = data[10]
+	v.FilterMethod = data[11]
+	v.InterlaceMethod = data[12]
+	return nil
+}
+
+func (v *frameControl) UnmarshalBinary(data []byte) error {
+	if len(data) != frameControlSize {
+		return formatError("Len is not valid. required: %d, actual: %d", frameControlSize, len(data))
+	}
+	v.SequenceNumber = binary.BigEndian.Uint32(data[:4])
+	v.Width = binary.BigEndian.Uint32(data[4:8])
+	v.Height = binary.BigEndian.Uint32(data[8:12])
+	v.XOffset = binary.BigEndian.Uint32(data[12:16])
+	v.YOffset = binary.BigEndian.Uint32(data[16:20])
+	v.DelayNum = binary.BigEndian.Uint16(data[20:22])
+	v.DelayDen = binary.BigEndian.Uint16(data[22:24])
+	v.DisposeOp = data[24]
+	v.BlendOp = data[25]
+	return nil
+}
+
+// validate checks the header fields against the PNG specification.
+func (v *imageHeader) validate() error {
+	if v.Width == 0 || v.Height == 0 || v.Width > maxPngChunkLength || v.Height > maxPngChunkLength {
+		return formatError("Invalid image size: %dx%d", v.Width, v.Height)
+	}
+	depths := map[byte][]byte{
+		0:                           {1, 2, 4, 8, 16},
+		trueColorUsed:               {8, 16},
+		paletteUsed | trueColorUsed: {1, 2, 4, 8},
+		alphaUsed:                   {8, 16},
+		trueColorUsed | alphaUsed:   {8, 16},
+	}
+	allowed, ok := depths[v.ColorType]
+	if !ok {
+		return formatError("Unknown color type: %d", v.ColorType)
+	}
+	if bytes.IndexByte(allowed, v.BitDepth) == -1 {
+		return formatError("Invalid bit depth %d for color type %d", v.BitDepth, v.ColorType)
+	}
+	if v.CompressionMethod != deflateCompression {
+		return &UnsupportedError{Feature: fmt.Sprintf("compression method %d", v.CompressionMethod)}
+	}
+	if v.FilterMethod != 0 {
+		return &UnsupportedError{Feature: fmt.Sprintf("filter method %d", v.FilterMethod)}
+	}
+	if v.InterlaceMethod > adam7Interlace {
+		return formatError("Unknown interlace method: %d", v.InterlaceMethod)
+	}
+	return nil
+}
+
+// bitsPerPixel returns the number of bits of a pixel in the image data.
+func (v *imageHeader) bitsPerPixel() int {
+	channels := 1
+	switch v.ColorType {
+	case trueColorUsed:
+		channels = 3
+	case alphaUsed:
+		channels = 2
+	case trueColorUsed | alphaUsed:
+		channels = 4
+	}
+	return channels * int(v.BitDepth)
+}
+
+func readPngSignature(r io.Reader) error {
+	var buf [8]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return err
+	}
+	if !bytes.Equal(buf[:], pngSignature) {
+		return formatError("Unknown signature: % x", buf[:])
+	}
+	return nil
+}
+
+func readChunkHeader(r io.Reader) (length uint32, chunkType string, err error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return 0, "", err
+	}
+	length = binary.BigEndian.Uint32(buf[:4])
+	if length > maxPngChunkLength {
+		return 0, "", formatError("Chunk length is too large: %d", length)
+	}
+	return length, string(buf[4:]), nil
+}
+
+// readChunkData reads the data and the CRC of a chunk. The buffer grows as the
+// data arrives, so that a bogus length does not allocate memory up front.
+func readChunkData(r io.Reader, length uint32, chunkType string) ([]byte, error) {
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, r, int64(length))
+	if err == io.EOF && n < int64(length) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	var crc [4]byte
+	if _, err := io.ReadFull(r, crc[:]); err != nil {
+		return nil, err
+	}
+	data := buf.Bytes()
+	actual := crc32.Update(crc32.ChecksumIEEE([]byte(chunkType)), crc32.IEEETable, data)
+	if expected := binary.BigEndian.Uint32(crc[:]); actual != expected {
+		return nil, formatError("CRC mismatch: 0x%08x, expected 0x%08x", actual, expected)
+	}
+	return data, nil
+}
+
+// Adam7 passes: the first column and row, and the distances between them.
+var adam7 = [7][4]int{
+	{0, 0, 8, 8},
+	{4, 0, 8, 8},
+	{0, 4, 4, 8},
+	{2, 0, 4, 4},
+	{0, 2, 2, 4},
+	{1, 0, 2, 2},
+	{0, 1, 1, 2},
+}
+
+func unfilter(cur, prev []byte, bpp int, filterType byte) error {
+	switch filterType {
+	case noneFilter:
+	case subFilter:
+		for i := bpp; i < len(cur); i++ {
+			cur[i] += cur[i-bpp]
+		}
+	case upFilter:
+		for i := range cur {
+			cur[i] += prev[i]
+		}
+	case averageFilter:
+		for i := range cur {
+			var a byte
+			if i >= bpp {
+				a = cur[i-bpp]
+			}
+			cur[i] += byte((int(a) + int(prev[i])) / 2)
+		}
+	case paethFilter:
+		for i := range cur {
+			var a, c byte
+			if i >= bpp {
+				a, c = cur[i-bpp], prev[i-bpp]
+			}
+			cur[i] += paeth(a, prev[i], c)
+		}
+	default:
+		return formatError("Unknown filter type: %d", filterType)
+	}
+	return nil
+}
+
+// pngDecoder holds the state of ReadPngWithOptions between chunks.
+type pngDecoder struct {
+	header  imageHeader
+	palette Palette
+	trns    []byte
+
+	animated  bool
+	numFrames uint32
+	numPlays  uint32
+	seq       uint32
+
+	// control is the fcTL of the next frame, nil for the default image of an
+	// animation which is not part of it.
+	control *frameControl
+	// pending holds the image data of the chunks of type collecting.
+	pending    bytes.Buffer
+	collecting string
+	idatDone   bool
+
+	frames     []ImageFrame
+	totalBytes int64
+}
+
+// sample returns the sample at index i of a row of samples of the bit depth.
+func sample(row []byte, i int, depth byte) int {
+	switch depth {
+	case 16:
+		return int(row[i*2])<<8 | int(row[i*2+1])
+	case 8:
+		return int(row[i])
+	}
+	bit := i * int(depth)
+	return int(row[bit/8]>>(8-int(depth)-bit%8)) & (1<<depth - 1)
+}
+
+// to8 scales a sample of the bit depth to 8 bits.
+func to8(s int, depth byte) byte {
+	switch depth {
+	case 16:
+		return byte(s >> 8)
+	case 8:
+		return byte(s)
+	}
+	return byte(s * 255 / (1<<depth - 1))
+}
+
+// setPixel converts pixel x of a row to a palette index, or to RGBA for
+// other color types, and stores it at p.
+func (v *pngDecoder) setPixel(p []byte, row []byte, x int) {
+	h := &v.header
+	d := h.BitDepth
+	switch h.ColorType {
+	case paletteUsed | trueColorUsed:
+		p[0] = byte(sample(row, x, d))
+	case 0:
+		g := sample(row, x, d)
+		p[0], p[1], p[2], p[3] = to8(g, d), to8(g, d), to8(g, d), 255
+		if len(v.trns) == 2 && g == int(binary.BigEndian.Uint16(v.trns)) {
+			p[3] = 0
+		}
+	case trueColorUsed:
+		r, g, b := sample(row, x*3, d), sample(row, x*3+1, d), sample(row, x*3+2, d)
+		p[0], p[1], p[2], p[3] = to8(r, d), to8(g, d), to8(b, d), 255
+		if len(v.trns) == 6 && r == int(binary.BigEndian.Uint16(v.trns)) &&
+			g == int(binary.BigEndian.Uint16(v.trns[2:])) && b == int(binary.BigEndian.Uint16(v.trns[4:])) {
+			p[3] = 0
+		}
+	case alphaUsed:
+		g := to8(sample(row, x*2, d), d)
+		p[0], p[1], p[2], p[3] = g, g, g, to8(sample(row, x*2+1, d), d)
+	case trueColorUsed | alphaUsed:
+		for c := 0; c < 4; c++ {
+			p[c] = to8(sample(row, x*4+c, d), d)
+		}
+	}
+}
+
+// decodeImage inflates and unfilters the image data of a width x height image.
+// The pixels are palette indices for color type 3 and RGBA otherwise.
+func (v *pngDecoder) decodeImage(compressed []byte, width, height int) ([]byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, formatError("Invalid image data: %v", err)
+	}
+	defer zr.Close()
+
+	ps := 4
+	if v.header.ColorType == paletteUsed|trueColorUsed {
+		ps = 1
+	}
+	bits := v.header.bitsPerPixel()
+	bpp := max(bits/8, 1)
+	passes := [][4]int{{0, 0, 1, 1}}
+	if v.header.InterlaceMethod == adam7Interlace {
+		passes = adam7[:]
+	}
+
+	// Inflate first, so that a few bytes of image data can not make the
+	// decoder allocate pixels for a huge canvas.
+	size := 0
+	for _, pass := range passes {
+		x0, y0, dx, dy := pass[0], pass[1], pass[2], pass[3]
+		if x0 < width && y0 < height {
+			w := (width - x0 + dx - 1) / dx
+			size += (height - y0 + dy - 1) / dy * ((w*bits+7)/8 + 1)
+		}
+	}
+	raw, err := io.ReadAll(io.LimitReader(zr, int64(size)))
+	if err != nil {
+		return nil, formatError("Invalid image data: %v", err)
+	}
+	if len(raw) < size {
+		return nil, formatError("Image data is too short")
+	}
+
+	pixels := make([]byte, width*height*ps)
+	for _, pass := range passes {
+		x0, y0, dx, dy := pass[0], pass[1], pass[2], pass[3]
+		if x0 >= width || y0 >= height {
+			continue
+		}
+		w := (width - x0 + dx - 1) / dx
+		rowLen := (w*bits + 7) / 8
+		prev := make([]byte, rowLen)
+		for y := y0; y < height; y += dy {
+			cur := raw[:rowLen+1]
+			raw = raw[rowLen+1:]
+			row := cur[1:]
+			if err := unfilter(row, prev, bpp, cur[0]); err != nil {
+				return nil, err
+			}
+			for i := 0; i < w; i++ {
+				x := x0 + i*dx
+				v.setPixel(pixels[(y*width+x)*ps:], row, i)
+			}
+			copy(prev, row)
+		}
+	}
+	return pixels, nil
+}
+
+func (v *pngDecoder) checkSequence(seq uint32) error {
+	if seq != v.seq {
+		return formatError("Sequence number out of order: %d, expected %d", seq, v.seq)
+	}
+	v.seq++
+	return nil
+}
+
+// finishImage decodes the collected image data as a frame.
+func (v *pngDecoder) finishImage(opts *DecodeOptions) error {
+	if v.collecting == "" {
+		return nil
+	}
+	if v.collecting == "IDAT" {
+		v.idatDone = true
+	}
+	v.collecting = ""
+	if v.animated && v.control == nil {
+		// The default image is not part of the animation.
+		v.pending.Reset()
+		return nil
+	}
+
+	f := ImageFrame{
+		width:             int(v.header.Width),
+		height:            int(v.header.Height),
+		transparencyIndex: -1,
+		disposal:          disposalNone,
+	}
+	if c := v.control; c != nil {
+		f.width, f.height = int(c.Width), int(c.Height)
+		f.xOffset, f.yOffset = int(c.XOffset), int(c.YOffset)
+		den := int(c.DelayDen)
+		if den == 0 {
+			den = 100
+		}
+		f.delay = int(math.Round(float64(c.DelayNum) * 100 / float64(den)))
+		switch c.DisposeOp {
+		case disposeOpBackground:
+			f.disposal = disposalBackground
+		case disposeOpPrevious:
+			f.disposal = disposalPrevious
+		}
+		f.source = c.BlendOp == blendOpSource
+		v.control = nil
+	}
+
+	ps := int64(4)
+	if v.header.ColorType == paletteUsed|trueColorUsed {
+		ps = 1
+	}
+	v.totalBytes += int64(f.width) * int64(f.height) * ps
+	if err := opts.checkFrame(len(v.frames)+1, f.width, f.height, v.totalBytes); err != nil {
+		return err
+	}
+	var err error
+	f.data, err = v.decodeImage(v.pending.Bytes(), f.width, f.height)
+	if err != nil {
+		return err
+	}
+	v.pending.Reset()
+	v.frames = append(v.frames, f)
+	return nil
+}
+
+func (v *pngDecoder) readFrameControl(data []byte) error {
+	var c frameControl
+	if err := c.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	if err := v.checkSequence(c.SequenceNumber); err != nil {
+		return err
+	}
+	if c.Width == 0 || c.Height == 0 ||
+		uint64(c.XOffset)+uint64(c.Width) > uint64(v.header.Width) ||
+		uint64(c.YOffset)+uint64(c.Height) > uint64(v.header.Height) {
+		return formatError("Frame exceeds the canvas: %dx%d at (%d, %d)", c.Width, c.Height, c.XOffset, c.YOffset)
+	}
+	if len(v.frames) == 0 && (c.XOffset != 0 || c.YOffset != 0 || c.Width != v.header.Width || c.Height != v.header.Height) {
+		return formatError("First frame does not cover the canvas")
+	}
+	if c.DisposeOp > disposeOpPrevious {
+		return formatError("Unknown dispose op: %d", c.DisposeOp)
+	}
+	if c.BlendOp > blendOpOver {
+		return formatError("Unknown blend op: %d", c.BlendOp)
+	}
+	v.control = &c
+	return nil
+}
+
+// ReadPng reads the image data from reader as PNG or APNG format.
+func ReadPng(r io.Reader) (*ImageData, error) {
+	return ReadPngWithOptions(r, nil)
+}
+
+// ReadPngWithOptions reads the image data from reader as PNG or APNG format,
+// enforcing the limits of opts. Without MaxCanvasPixels, canvases of more than
+// 2^28 pixels are rejected with a *LimitError. Frames keep their offsets, delays, dispose ops
+// and blend ops. The default image of an animation is dropped unless it is the
+// first frame. Errors are reported like ReadGifWithOptions does, with the chunk
+// type as block.
+func ReadPngWithOptions(r io.Reader, opts *DecodeOptions) (*ImageData, error) {
+	cr := &countingReader{r: r}
+	var pos ErrorPosition
+	data, err := readPng(cr, &pos, opts)
+	if err != nil {
+		return nil, withPosition(err, cr, pos)
+	}
+	return data, nil
+}
+
+func readPng(r *countingReader, pos *ErrorPosition, opts *DecodeOptions) (*ImageData, error) {
+	var d pngDecoder
+
+	pos.moveTo("Signature", r, 0)
+	if err := readPngSignature(r); err != nil {
+		return nil, err
+	}
+
+	for first := true; ; first = false {
+		pos.moveTo("Chunk", r, len(d.frames))
+		length, chunkType, err := readChunkHeader(r)
+		if err != nil {
+			return nil, err
+		}
+		pos.Block = chunkType
+		data, err := readChunkData(r, length, chunkType)
+		if err != nil {
+			return nil, err
+		}
+		if first != (chunkType == "IHDR") {
+			return nil, formatError("IHDR must be the first chunk")
+		}
+		if chunkType != d.collecting {
+			if err := d.finishImage(opts); err != nil {
+				return nil, err
+			}
+		}
+
+		switch chunkType {
+		case "IHDR":
+			if err := d.header.UnmarshalBinary(data); err != nil {
+				return nil, err
+			}
+			if err := d.header.validate(); err != nil {
+				return nil, err
+			}
+			maxPixels := int64(defaultMaxPngPixels)
+			if opts != nil && opts.MaxCanvasPixels > 0 {
+				maxPixels = int64(opts.MaxCanvasPixels)
+			}
+			if err := checkLimit("MaxCanvasPixels", maxPixels, int64(d.header.Width)*int64(d.header.Height)); err != nil {
+				return nil, err
+			}
+		case "PLTE":
+			if len(data)%3 != 0 || len(data) == 0 || len(data) > 256*3 {
+				return nil, formatError("Invalid palette length: %d", len(data))
+			}
+			d.palette = make(Palette, len(data)/3)
+			d.palette.UnmarshalBinary(data)
+		case "tRNS":
+			switch d.header.ColorType {
+			case paletteUsed | trueColorUsed:
+				if len(data) > len(d.palette) {
+					return nil, formatError("tRNS has %d entries for %d colors", len(data), len(d.palette))
+				}
+			case 0:
+				if len(data) != 2 {
+					return nil, formatError("Len is not valid. required: %d, actual: %d", 2, len(data))
+				}
+			case trueColorUsed:
+				if len(data) != 6 {
+					return nil, formatError("Len is not valid. required: %d, actual: %d", 6, len(data))
+				}
+			default:
+				return nil, formatError("tRNS is not allowed for color type %d", d.header.ColorType)
+			}
+			d.trns = data
+		case "acTL":
+			if len(data) != animationCtrlSize {
+				return nil, formatError("Len is not valid. required: %d, actual: %d", animationCtrlSize, len(data))
+			}
+			if d.collecting != "" || d.idatDone {
+				return nil, formatError("acTL after image data")
+			}
+			d.animated = true
+			d.numFrames = binary.BigEndian.Uint32(data)
+			if d.numFrames == 0 {
+				return nil, formatError("acTL has no frames")
+			}
+			d.numPlays = binary.BigEndian.Uint32(data[4:])
+		case "fcTL":
+			if !d.animated {
+				return nil, formatError("fcTL without acTL")
+			}
+			if err := d.readFrameControl(data); err != nil {
+				return nil, err
+			}
+		case "IDAT":
+			if d.header.ColorType == paletteUsed|trueColorUsed && d.palette == nil {
+				return nil, formatError("No PLTE before IDAT")
+			}
+			if d.idatDone {
+				return nil, formatError("IDAT chunks are not contiguous")
+			}
+			d.collecting = chunkType
+			d.pending.Write(data)
+		case "fdAT":
+			if len(data) < pngSequenceNumSize {
+				return nil, formatError("Len is not enough. required: %d, actual: %d", pngSequenceNumSize, len(data))
+			}
+			if err := d.checkSequence(binary.BigEndian.Uint32(data)); err != nil {
+				return nil, err
+			}
+			if !d.idatDone || (d.control == nil && d.collecting == "") {
+				return nil, formatError("fdAT without fcTL")
+			}
+			d.collecting = chunkType
+			d.pending.Write(data[pngSequenceNumSize:])
+		case "IEND":
+			return d.imageData()
+		default:
+			if chunkType[0]&0x20 == 0 {
+				return nil, &UnsupportedError{Feature: "critical chunk " + chunkType}
+			}
+		}
+	}
+}
+
+// paletteTransparency returns the palette entry tRNS makes transparent, or -1.
+// It fails if entries are translucent or more than one is transparent.
+func (v *pngDecoder) paletteTransparency() (int, bool) {
+	index := -1
+	for i, a := range v.trns {
+		switch {
+		case a == 255:
+		case a == 0 && index == -1:
+			index = i
+		default:
+			return -1, false
+		}
+	}
+	return index, true
+}
+
+// showsCanvas reports whether the transparent black canvas of an animation
+// can become visible: every frame but the last is disposed to it or to an
+// earlier state.
+func (v *pngDecoder) showsCanvas() bool {
+	for _, f := range v.frames[:len(v.frames)-1] {
+		if f.disposal != disposalNone {
+			return true
+		}
+	}
+	return false
+}
+
+// imageData converts the decoded frames to ImageData. Palette images keep
+// palette frames if the canvas can be expressed with the palette, and other
+// images have RGBA frames.
+func (v *pngDecoder) imageData() (*ImageData, error) {
+	if !v.idatDone {
+		return nil, formatError("No IDAT")
+	}
+	if v.control != nil {
+		return nil, formatError("fcTL without image data")
+	}
+	if v.animated && uint32(len(v.frames)) != v.numFrames {
+		return nil, formatError("Frame count mismatch. acTL: %d, actual: %d", v.numFrames, len(v.frames))
+	}
+	data := &ImageData{
+		width:             int(v.header.Width),
+		height:            int(v.header.Height),
+		transparencyIndex: -1,
+		frames:            v.frames,
+		loopCount:         int(v.numPlays),
+	}
+	if v.header.ColorType != paletteUsed|trueColorUsed {
+		data.truecolor = true
+		return data, nil
+	}
+
+	if index, ok := v.paletteTransparency(); ok && (index != -1 || !v.showsCanvas()) {
+		data.palette = v.palette
+		data.transparencyIndex = index
+		data.backgroundIndex = max(index, 0)
+		for i := range data.frames {
+			data.frames[i].transparencyIndex = index
+		}
+		return data, nil
+	}
+
+	data.truecolor = true
+	for i := range data.frames {
+		f := &data.frames[i]
+		rgba := make([]byte, len(f.data)*4)
+		for j, c := range f.data {
+			if int(c) < len(v.palette) {
+				rgba[j*4] = v.palette[c].r
+				rgba[j*4+1] = v.palette[c].g
+				rgba[j*4+2] = v.palette[c].b
+			}
+			rgba[j*4+3] = 255
+			if int(c) < len(v.trns) {
+				rgba[j*4+3] = v.trns[c]
+			}
+		}
+		f.data = rgba
+	}
+	return data, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// optimizeCandidates returns the encodings OptimizePng tries. They keep every
+// option of opts except the color mode, bit depth, filter and compression level.
+// The candidates run in parallel, so each one compresses its frames sequentially.
+func optimizeCandidates(data *ImageData, opts *EncodeOptions) []EncodeOptions {
+	depths := []int{0}
+	if p, _, err := prepareColors(data, ColorPalette); err == nil {
+		if depth := minPaletteDepth(len(p.palette)); depth != 8 {
+			depths = append(depths, depth)
+		}
+	}
+
+	var candidates []EncodeOptions
+	for _, mode := range []ColorMode{ColorAuto, ColorPalette, ColorRGB, ColorRGBA} {
+		for _, depth := range depths {
+			if depth != 0 && mode != ColorPalette {
+				continue
+			}
+			for filter := FilterNone; filter <= FilterAdaptive; filter++ {
+				for _, level := range []CompressionLevel{BestCompression, DefaultCompression} {
+					c := *opts
+					c.Optimize = false
+					c.Workers = 1
+					c.ColorMode = mode
+					c.BitDepth = depth
+					c.Filter = filter
+					c.Compression = level
+					candidates = append(candidates, c)
+				}
+			}
+		}
+	}
+	return candidates
+}
+
+// OptimizePng encodes the image data with every combination of color mode,
+// palette bit depth, filter strategy and compression level in parallel,
+// writes the smallest result to w and returns the options which produced it.
+// Combinations which can not express the image are skipped.
+func OptimizePng(w io.Writer, data *ImageData, opts *EncodeOptions) (*EncodeOptions, error) {
+	if opts == nil {
+		opts = &EncodeOptions{}
+	}
+	candidates := optimizeCandidates(data, opts)
+	errs := make([]error, len(candidates))
+
+	// Only the smallest result so far is kept. Of equal sizes, the first
+	// candidate wins, so the output does not depend on scheduling.
+	var (
+		mu   sync.Mutex
+		best = -1
+		out  *bytes.Buffer
+	)
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, runtime.NumCPU())
+	for i := range candidates {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			buf := &bytes.Buffer{}
+			if errs[i] = WritePngWithOptions(buf, data, &candidates[i]); errs[i] != nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if best == -1 || buf.Len() < out.Len() || buf.Len() == out.Len() && i < best {
+				best, out = i, buf
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if best == -1 {
+		return nil, errs[0]
+	}
+	if _, err := w.Write(out.Bytes()); err != nil {
+		return nil, err
+	}
+	return &candidates[best], nil
+}
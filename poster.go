@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// PosterMode selects how the poster frame is chosen.
+type PosterMode int
+
+const (
+	// PosterNone uses the first animation frame as the default image.
+	PosterNone PosterMode = iota
+	// PosterIndex uses the frame at Poster.Index.
+	PosterIndex
+	// PosterMiddle uses the frame in the middle of the animation.
+	PosterMiddle
+	// PosterMostColorful uses the frame showing the most distinct colors.
+	PosterMostColorful
+)
+
+// Poster selects the frame written as the default image of an APNG.
+// Except for PosterNone, the default image is not part of the animation,
+// so viewers without APNG support show it instead of the first frame.
+type Poster struct {
+	Mode  PosterMode
+	Index int
+}
+
+func (v Poster) String() string {
+	switch v.Mode {
+	case PosterIndex:
+		return strconv.Itoa(v.Index)
+	case PosterMiddle:
+		return "middle"
+	case PosterMostColorful:
+		return "colorful"
+	}
+	return ""
+}
+
+// Set parses a frame index, "middle" or "colorful", so that Poster can be used as a flag.Value.
+func (v *Poster) Set(s string) error {
+	switch s {
+	case "":
+		*v = Poster{}
+	case "middle":
+		*v = Poster{Mode: PosterMiddle}
+	case "colorful":
+		*v = Poster{Mode: PosterMostColorful}
+	default:
+		i, err := strconv.Atoi(s)
+		if err != nil || i < 0 {
+			return fmt.Errorf("Unknown poster frame: %s", s)
+		}
+		*v = Poster{Mode: PosterIndex, Index: i}
+	}
+	return nil
+}
+
+func countColors(frame *ImageFrame, ps int) int {
+	used := make(map[string]struct{})
+	for i := 0; i < len(frame.data); i += ps {
+		p := frame.data[i : i+ps]
+		if !isTransparent(frame, p) {
+			used[string(p)] = struct{}{}
+		}
+	}
+	return len(used)
+}
+
+// posterFrame composites the frame selected by poster.
+func posterFrame(data *ImageData, poster Poster) (*ImageFrame, error) {
+	composited := compositeFrames(data)
+	i := 0
+	switch poster.Mode {
+	case PosterIndex:
+		if poster.Index >= len(composited) {
+			return nil, fmt.Errorf("Poster frame out of range. frames: %d, index: %d", len(composited), poster.Index)
+		}
+		i = poster.Index
+	case PosterMiddle:
+		i = len(composited) / 2
+	case PosterMostColorful:
+		most := -1
+		for j := range composited {
+			if n := countColors(&composited[j], data.pixelSize()); n > most {
+				i, most = j, n
+			}
+		}
+	}
+	return &composited[i], nil
+}
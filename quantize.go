@@ -0,0 +1,100 @@
+package main
+
+// thresholdAlpha returns a copy of truecolor data whose pixels are either fully
+// transparent or opaque, as GIF can express. Alpha below 128 becomes transparent.
+func thresholdAlpha(data *ImageData) *ImageData {
+	t := *data
+	t.frames = make([]ImageFrame, len(data.frames))
+	for i, f := range data.frames {
+		d := append([]byte(nil), f.data...)
+		for j := 3; j < len(d); j += 4 {
+			if d[j] < 128 {
+				d[j-3], d[j-2], d[j-1], d[j] = 0, 0, 0, 0
+			} else {
+				d[j] = 255
+			}
+		}
+		t.frames[i] = f
+		t.frames[i].data = d
+	}
+	return &t
+}
+
+// Levels of the uniform color cube of quantizeCube.
+const (
+	cubeR = 6
+	cubeG = 7
+	cubeB = 6
+)
+
+func cubeLevel(c byte, levels int) int {
+	return (int(c)*(levels-1) + 127) / 255
+}
+
+// quantizeCube maps opaque RGBA frames to a global palette of a uniform
+// 6x7x6 color cube. Index 0 is reserved for transparent pixels.
+func quantizeCube(data *ImageData) *ImageData {
+	t := *data
+	t.truecolor = false
+	t.transparencyIndex = -1
+	t.backgroundIndex = 0
+	t.palette = make(Palette, 1, 1+cubeR*cubeG*cubeB)
+	for r := 0; r < cubeR; r++ {
+		for g := 0; g < cubeG; g++ {
+			for b := 0; b < cubeB; b++ {
+				t.palette = append(t.palette, Rgb{byte(r * 255 / (cubeR - 1)), byte(g * 255 / (cubeG - 1)), byte(b * 255 / (cubeB - 1))})
+			}
+		}
+	}
+	t.frames = make([]ImageFrame, len(data.frames))
+	for i, f := range data.frames {
+		d := make([]byte, len(f.data)/4)
+		for j := range d {
+			p := f.data[j*4 : j*4+4]
+			if p[3] == 0 {
+				t.transparencyIndex = 0
+				continue
+			}
+			d[j] = byte(1 + (cubeLevel(p[0], cubeR)*cubeG+cubeLevel(p[1], cubeG))*cubeB + cubeLevel(p[2], cubeB))
+		}
+		t.frames[i] = f
+		t.frames[i].data = d
+	}
+	for i := range t.frames {
+		t.frames[i].transparencyIndex = t.transparencyIndex
+	}
+	return &t
+}
+
+// gifPalettes reduces truecolor data to palette frames for GIF output.
+// All frames share one palette if their colors fit, otherwise each frame gets a
+// local palette, and if a frame has more than 256 colors all of them are mapped
+// to a uniform color cube.
+func gifPalettes(data *ImageData) *ImageData {
+	if !data.truecolor {
+		return data
+	}
+	t := thresholdAlpha(data)
+	if p, ok := toPalette(t); ok {
+		p.backgroundIndex = max(p.transparencyIndex, 0)
+		return p
+	}
+
+	local := *t
+	local.truecolor = false
+	local.palette = nil
+	local.transparencyIndex = -1
+	local.backgroundIndex = 0
+	local.frames = make([]ImageFrame, len(t.frames))
+	for i := range t.frames {
+		single := *t
+		single.frames = t.frames[i : i+1]
+		p, ok := toPalette(&single)
+		if !ok {
+			return quantizeCube(t)
+		}
+		local.frames[i] = p.frames[0]
+		local.frames[i].palette = p.palette
+	}
+	return &local
+}
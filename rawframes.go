@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// RawFormat selects the stream written by WriteRawFrames.
+type RawFormat int
+
+const (
+	// RawY4M writes YUV4MPEG2 with 4:2:0 BT.601 video range samples. Frames are
+	// blended onto black.
+	RawY4M RawFormat = iota
+	// RawPAM writes one PAM image with RGB_ALPHA tuples per frame.
+	RawPAM
+)
+
+var rawFormatNames = []string{"y4m", "pam"}
+
+func (v RawFormat) String() string {
+	if int(v) < len(rawFormatNames) {
+		return rawFormatNames[v]
+	}
+	return fmt.Sprintf("RawFormat(%d)", int(v))
+}
+
+// Set parses the name of a format, so that RawFormat can be used as a flag.Value.
+func (v *RawFormat) Set(s string) error {
+	for i, name := range rawFormatNames {
+		if s == name {
+			*v = RawFormat(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown raw format: %s", s)
+}
+
+// FrameRate is a number of frames per second, written as an integer or a
+// fraction such as 30000/1001.
+type FrameRate struct {
+	Num, Den int
+}
+
+func (v FrameRate) String() string {
+	if v.Num == 0 {
+		return "25"
+	}
+	if v.Den == 1 {
+		return strconv.Itoa(v.Num)
+	}
+	return fmt.Sprintf("%d/%d", v.Num, v.Den)
+}
+
+// Set parses a frame rate, so that FrameRate can be used as a flag.Value.
+func (v *FrameRate) Set(s string) error {
+	num, den, ok := strings.Cut(s, "/")
+	if !ok {
+		den = "1"
+	}
+	n, err1 := strconv.Atoi(num)
+	d, err2 := strconv.Atoi(den)
+	if err1 != nil || err2 != nil || n <= 0 || d <= 0 {
+		return fmt.Errorf("Invalid frame rate: %s", s)
+	}
+	*v = FrameRate{n, d}
+	return nil
+}
+
+// RawOptions configures WriteRawFrames.
+type RawOptions struct {
+	Format RawFormat
+
+	// Rate is the constant frame rate of the stream. Zero means 25.
+	Rate FrameRate
+}
+
+// resampleFrames returns, for every frame of a stream at rate, the index of the
+// composited frame shown at its start time. Frames with a zero delay are never
+// shown, and the stream lasts as long as the animation, but at least one frame.
+// If every delay of an animation is zero, frames last 10 cs as in browsers.
+func resampleFrames(frames []ImageFrame, rate FrameRate, opts *EncodeOptions) []int {
+	starts := make([]float64, len(frames))
+	var total float64
+	for i, f := range frames {
+		starts[i] = total
+		num, den := opts.frameDelay(f.delay)
+		total += float64(num) / float64(den)
+	}
+	if total == 0 && len(frames) > 1 {
+		for i := range starts {
+			starts[i] = float64(i) / 10
+		}
+		total = float64(len(frames)) / 10
+	}
+	n := max(1, int(math.Round(total*float64(rate.Num)/float64(rate.Den))))
+
+	indices := make([]int, n)
+	j := 0
+	for k := range indices {
+		t := float64(k) * float64(rate.Den) / float64(rate.Num)
+		for j+1 < len(frames) && starts[j+1] <= t+1e-9 {
+			j++
+		}
+		indices[k] = j
+	}
+	return indices
+}
+
+// appendYCbCr420 converts RGBA pixels blended onto black to planar 4:2:0
+// BT.601 video range YCbCr, averaging chroma over blocks of 2×2 pixels.
+func appendYCbCr420(b []byte, f *ImageFrame) []byte {
+	rgb := func(x, y int) (float64, float64, float64) {
+		p := f.data[(y*f.width+x)*4:]
+		a := float64(p[3]) / 255
+		return float64(p[0]) * a, float64(p[1]) * a, float64(p[2]) * a
+	}
+	for y := 0; y < f.height; y++ {
+		for x := 0; x < f.width; x++ {
+			r, g, bl := rgb(x, y)
+			b = append(b, byte(math.Round(16+(65.481*r+128.553*g+24.966*bl)/255)))
+		}
+	}
+	cw, ch := (f.width+1)/2, (f.height+1)/2
+	cb := make([]byte, 0, cw*ch)
+	cr := make([]byte, 0, cw*ch)
+	for y := 0; y < f.height; y += 2 {
+		for x := 0; x < f.width; x += 2 {
+			var r, g, bl, n float64
+			for _, p := range [][2]int{{x, y}, {x + 1, y}, {x, y + 1}, {x + 1, y + 1}} {
+				if p[0] < f.width && p[1] < f.height {
+					pr, pg, pb := rgb(p[0], p[1])
+					r, g, bl, n = r+pr, g+pg, bl+pb, n+1
+				}
+			}
+			r, g, bl = r/n, g/n, bl/n
+			cb = append(cb, byte(math.Round(128+(-37.797*r-74.203*g+112*bl)/255)))
+			cr = append(cr, byte(math.Round(128+(112*r-93.786*g-18.214*bl)/255)))
+		}
+	}
+	return append(append(b, cb...), cr...)
+}
+
+// WriteRawFrames writes the composited frames of data to w as an uncompressed
+// stream for piping into a video encoder. The delays are resampled to a constant
+// frame rate by repeating and dropping frames. Of opts, the timing options apply.
+func WriteRawFrames(w io.Writer, data *ImageData, raw *RawOptions, opts *EncodeOptions) error {
+	if opts == nil {
+		opts = &EncodeOptions{}
+	}
+	if len(data.frames) == 0 {
+		return fmt.Errorf("No frames to write")
+	}
+	if data.width == 0 || data.height == 0 {
+		return &UnsupportedError{Feature: fmt.Sprintf("image size %dx%d", data.width, data.height)}
+	}
+	rate := raw.Rate
+	if rate.Num == 0 {
+		rate = FrameRate{25, 1}
+	}
+	if rate.Num < 0 || rate.Den <= 0 {
+		return fmt.Errorf("Invalid frame rate: %v", rate)
+	}
+
+	frames := compositeFrames(toTruecolor(data))
+	bw := bufio.NewWriter(w)
+	switch raw.Format {
+	case RawY4M:
+		fmt.Fprintf(bw, "YUV4MPEG2 W%d H%d F%d:%d Ip A1:1 C420jpeg\n", data.width, data.height, rate.Num, rate.Den)
+	case RawPAM:
+	default:
+		return fmt.Errorf("Unknown raw format: %v", raw.Format)
+	}
+
+	var frame []byte
+	last := -1
+	for _, i := range resampleFrames(frames, rate, opts) {
+		if i != last {
+			f := &frames[i]
+			if raw.Format == RawY4M {
+				frame = appendYCbCr420(append(frame[:0], "FRAME\n"...), f)
+			} else {
+				frame = fmt.Appendf(frame[:0], "P7\nWIDTH %d\nHEIGHT %d\nDEPTH 4\nMAXVAL 255\nTUPLTYPE RGB_ALPHA\nENDHDR\n", f.width, f.height)
+				frame = append(frame, f.data...)
+			}
+			last = i
+		}
+		if _, err := bw.Write(frame); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
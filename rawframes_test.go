@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestResampleFrames(t *testing.T) {
+	for _, c := range []struct {
+		delays []int
+		rate   FrameRate
+		want   []int
+	}{
+		{[]int{10, 10, 10}, FrameRate{10, 1}, []int{0, 1, 2}},
+		{[]int{10, 20}, FrameRate{20, 1}, []int{0, 0, 1, 1, 1, 1}},
+		{[]int{5, 5, 5, 5}, FrameRate{10, 1}, []int{0, 2}},
+		{[]int{0, 10, 0, 10}, FrameRate{10, 1}, []int{1, 3}},
+		{[]int{0, 0}, FrameRate{25, 1}, []int{0, 0, 0, 1, 1}},
+		{[]int{0}, FrameRate{25, 1}, []int{0}},
+		{[]int{100}, FrameRate{30000, 1001}, slices.Repeat([]int{0}, 30)},
+	} {
+		frames := make([]ImageFrame, len(c.delays))
+		for i, d := range c.delays {
+			frames[i].delay = d
+		}
+		if got := resampleFrames(frames, c.rate, &EncodeOptions{}); !slices.Equal(got, c.want) {
+			t.Errorf("%v at %v: %v, want %v", c.delays, c.rate, got, c.want)
+		}
+	}
+}
+
+func TestFrameRate(t *testing.T) {
+	for _, c := range []struct {
+		rate FrameRate
+		want string
+	}{
+		{FrameRate{}, "25"},
+		{FrameRate{10, 1}, "10"},
+		{FrameRate{30000, 1001}, "30000/1001"},
+	} {
+		if got := c.rate.String(); got != c.want {
+			t.Errorf("%+v: %q, want %q", c.rate, got, c.want)
+		}
+	}
+	for _, s := range []string{"0", "-1", "25/0", "x"} {
+		var rate FrameRate
+		if err := rate.Set(s); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
+
+func TestYCbCr420(t *testing.T) {
+	f := &ImageFrame{width: 3, height: 1, data: []byte{
+		255, 255, 255, 255,
+		0, 0, 0, 255,
+		255, 0, 0, 0,
+	}}
+	want := []byte{235, 16, 16, 128, 128, 128, 128}
+	if got := appendYCbCr420(nil, f); !bytes.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestRawFrames(t *testing.T) {
+	for _, c := range corpus {
+		t.Run(c.name, func(t *testing.T) {
+			data, err := ReadGif(bytes.NewReader(c.gif()), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n := len(resampleFrames(data.frames, FrameRate{25, 1}, &EncodeOptions{}))
+
+			var out bytes.Buffer
+			if err := WriteRawFrames(&out, data, &RawOptions{Format: RawY4M}, nil); err != nil {
+				t.Fatal(err)
+			}
+			header := fmt.Sprintf("YUV4MPEG2 W%d H%d F25:1 Ip A1:1 C420jpeg\n", data.width, data.height)
+			frameSize := len("FRAME\n") + data.width*data.height + 2*((data.width+1)/2)*((data.height+1)/2)
+			if !bytes.HasPrefix(out.Bytes(), []byte(header)) || out.Len() != len(header)+n*frameSize {
+				t.Errorf("Y4M stream of %d bytes, want %d frames of %d bytes", out.Len(), n, frameSize)
+			}
+
+			out.Reset()
+			if err := WriteRawFrames(&out, data, &RawOptions{Format: RawPAM}, nil); err != nil {
+				t.Fatal(err)
+			}
+			header = fmt.Sprintf("P7\nWIDTH %d\nHEIGHT %d\nDEPTH 4\nMAXVAL 255\nTUPLTYPE RGB_ALPHA\nENDHDR\n", data.width, data.height)
+			if out.Len() != n*(len(header)+data.width*data.height*4) {
+				t.Errorf("PAM stream of %d bytes, want %d frames", out.Len(), n)
+			}
+		})
+	}
+}
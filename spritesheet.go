@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// SheetLayout selects how WriteSpriteSheet arranges the frames.
+type SheetLayout int
+
+const (
+	// SheetNone writes an animation instead of a sprite sheet.
+	SheetNone SheetLayout = iota
+	// SheetGrid places the full frames in rows of equal cells.
+	SheetGrid
+	// SheetPacked trims the transparent border of every frame, stores identical
+	// frames once and packs them in shelves.
+	SheetPacked
+)
+
+var sheetLayoutNames = []string{"none", "grid", "packed"}
+
+func (v SheetLayout) String() string {
+	if int(v) < len(sheetLayoutNames) {
+		return sheetLayoutNames[v]
+	}
+	return fmt.Sprintf("SheetLayout(%d)", int(v))
+}
+
+// Set parses the name of a layout, so that SheetLayout can be used as a flag.Value.
+func (v *SheetLayout) Set(s string) error {
+	for i, name := range sheetLayoutNames {
+		if s == name {
+			*v = SheetLayout(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown sheet layout: %s", s)
+}
+
+// SheetOptions configures WriteSpriteSheet.
+type SheetOptions struct {
+	Layout SheetLayout
+
+	// Columns is the number of grid columns. Zero makes the grid about square.
+	Columns int
+
+	// Padding is the number of transparent pixels between frames.
+	Padding int
+
+	// ImageName is the file name of the sheet written to the atlas.
+	ImageName string
+}
+
+type atlasRect struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+type atlasSize struct {
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+// atlasFrame locates a frame in the sheet. spriteSourceSize is the part of the
+// canvas the stored pixels come from, and duration is in milliseconds.
+type atlasFrame struct {
+	Filename         string    `json:"filename"`
+	Frame            atlasRect `json:"frame"`
+	Rotated          bool      `json:"rotated"`
+	Trimmed          bool      `json:"trimmed"`
+	SpriteSourceSize atlasRect `json:"spriteSourceSize"`
+	SourceSize       atlasSize `json:"sourceSize"`
+	Duration         int       `json:"duration"`
+}
+
+type atlasMeta struct {
+	App     string    `json:"app"`
+	Version string    `json:"version"`
+	Image   string    `json:"image"`
+	Format  string    `json:"format"`
+	Size    atlasSize `json:"size"`
+	Scale   string    `json:"scale"`
+}
+
+// spriteAtlas follows the JSON array format of TexturePacker.
+type spriteAtlas struct {
+	Frames []atlasFrame `json:"frames"`
+	Meta   atlasMeta    `json:"meta"`
+}
+
+// opaqueRect returns the bounding box of the pixels of an RGBA frame which are
+// not transparent, or an empty rect.
+func opaqueRect(frame *ImageFrame) rect {
+	r := rect{frame.width, frame.height, 0, 0}
+	for y := 0; y < frame.height; y++ {
+		for x := 0; x < frame.width; x++ {
+			if frame.data[(y*frame.width+x)*4+3] == 0 {
+				continue
+			}
+			r.x0 = min(r.x0, x)
+			r.y0 = min(r.y0, y)
+			r.x1 = max(r.x1, x+1)
+			r.y1 = max(r.y1, y+1)
+		}
+	}
+	return r
+}
+
+// sprite is the part r of a composited frame which is stored at x, y in the
+// sheet, or where alias is if it has the same pixels.
+type sprite struct {
+	frame *ImageFrame
+	r     rect
+	x, y  int
+	alias *sprite
+}
+
+// gridSprites places the full frames in cells of columns columns.
+func gridSprites(frames []ImageFrame, columns, padding int) ([]*sprite, int, int) {
+	width, height := frames[0].width, frames[0].height
+	if columns == 0 {
+		columns = int(math.Ceil(math.Sqrt(float64(len(frames)))))
+	}
+	columns = min(columns, len(frames))
+	rows := (len(frames) + columns - 1) / columns
+
+	sprites := make([]*sprite, len(frames))
+	for i := range frames {
+		sprites[i] = &sprite{
+			frame: &frames[i],
+			r:     rect{0, 0, width, height},
+			x:     i % columns * (width + padding),
+			y:     i / columns * (height + padding),
+		}
+	}
+	return sprites, columns*(width+padding) - padding, rows*(height+padding) - padding
+}
+
+// packedSprites trims the frames and packs them in shelves of about the width
+// of a square sheet. Identical trimmed frames share one sprite.
+func packedSprites(frames []ImageFrame, padding int) ([]*sprite, int, int) {
+	sprites := make([]*sprite, len(frames))
+	seen := make(map[string]*sprite)
+	var unique []*sprite
+	area, widest := 0, 0
+	for i := range frames {
+		r := opaqueRect(&frames[i])
+		if r.empty() {
+			r = rect{0, 0, 1, 1}
+		}
+		sprites[i] = &sprite{frame: &frames[i], r: r}
+		key := fmt.Sprint(r.x1-r.x0, r.y1-r.y0, string(cropRGBA(&frames[i], r)))
+		if s, ok := seen[key]; ok {
+			sprites[i].alias = s
+			continue
+		}
+		seen[key] = sprites[i]
+		unique = append(unique, sprites[i])
+		area += (r.x1 - r.x0 + padding) * (r.y1 - r.y0 + padding)
+		widest = max(widest, r.x1-r.x0)
+	}
+
+	sort.SliceStable(unique, func(i, j int) bool {
+		return unique[i].r.y1-unique[i].r.y0 > unique[j].r.y1-unique[j].r.y0
+	})
+	target := max(widest, int(math.Ceil(math.Sqrt(float64(area)))))
+	x, y, shelf, width := 0, 0, 0, 0
+	for _, s := range unique {
+		w, h := s.r.x1-s.r.x0, s.r.y1-s.r.y0
+		if x > 0 && x+w > target {
+			x, y, shelf = 0, y+shelf+padding, 0
+		}
+		s.x, s.y = x, y
+		x += w + padding
+		shelf = max(shelf, h)
+		width = max(width, s.x+w)
+	}
+	for _, s := range sprites {
+		if s.alias != nil {
+			s.x, s.y = s.alias.x, s.alias.y
+		}
+	}
+	return sprites, width, y + shelf
+}
+
+// cropRGBA returns the pixels of r in an RGBA frame.
+func cropRGBA(frame *ImageFrame, r rect) []byte {
+	b := make([]byte, 0, (r.x1-r.x0)*(r.y1-r.y0)*4)
+	for y := r.y0; y < r.y1; y++ {
+		b = append(b, frame.data[(y*frame.width+r.x0)*4:(y*frame.width+r.x1)*4]...)
+	}
+	return b
+}
+
+// spriteSheet composites the frames of data and packs them into a still RGBA
+// image as configured by sheet, with the atlas describing it.
+func spriteSheet(data *ImageData, sheet *SheetOptions, opts *EncodeOptions) (*ImageData, *spriteAtlas, error) {
+	if sheet.Columns < 0 || sheet.Padding < 0 {
+		return nil, nil, fmt.Errorf("Columns and padding must not be negative: %d, %d", sheet.Columns, sheet.Padding)
+	}
+	frames := compositeFrames(toTruecolor(data))
+	if opts.MergeDuplicateFrames {
+		frames = mergeDuplicateFrames(frames)
+	}
+
+	var (
+		sprites       []*sprite
+		width, height int
+	)
+	switch sheet.Layout {
+	case SheetGrid:
+		sprites, width, height = gridSprites(frames, sheet.Columns, sheet.Padding)
+	case SheetPacked:
+		sprites, width, height = packedSprites(frames, sheet.Padding)
+	default:
+		return nil, nil, fmt.Errorf("Unknown sheet layout: %v", sheet.Layout)
+	}
+
+	pixels := make([]byte, width*height*4)
+	atlas := &spriteAtlas{
+		Meta: atlasMeta{
+			App:     "gif2png",
+			Version: "1.0",
+			Image:   sheet.ImageName,
+			Format:  "RGBA8888",
+			Size:    atlasSize{width, height},
+			Scale:   "1",
+		},
+	}
+	for i, s := range sprites {
+		w, h := s.r.x1-s.r.x0, s.r.y1-s.r.y0
+		for y := 0; y < h; y++ {
+			copy(pixels[((s.y+y)*width+s.x)*4:], s.frame.data[((s.r.y0+y)*s.frame.width+s.r.x0)*4:((s.r.y0+y)*s.frame.width+s.r.x1)*4])
+		}
+		atlas.Frames = append(atlas.Frames, atlasFrame{
+			Filename:         fmt.Sprintf("frame_%04d", i),
+			Frame:            atlasRect{s.x, s.y, w, h},
+			Trimmed:          w != data.width || h != data.height,
+			SpriteSourceSize: atlasRect{s.r.x0, s.r.y0, w, h},
+			SourceSize:       atlasSize{data.width, data.height},
+			Duration:         opts.frameDuration(s.frame.delay),
+		})
+	}
+
+	image := &ImageData{
+		width:             width,
+		height:            height,
+		transparencyIndex: -1,
+		truecolor:         true,
+		frames: []ImageFrame{{
+			width:             width,
+			height:            height,
+			transparencyIndex: -1,
+			data:              pixels,
+		}},
+	}
+	return image, atlas, nil
+}
+
+// WriteSpriteSheet writes the composited frames of data packed into one still
+// PNG to w, and the atlas locating them to atlas as JSON in the array format of
+// TexturePacker, with frame durations in milliseconds. Of opts, the timing
+// options and MergeDuplicateFrames apply to the atlas, and the others to the PNG.
+func WriteSpriteSheet(w io.Writer, atlas io.Writer, data *ImageData, sheet *SheetOptions, opts *EncodeOptions) error {
+	if opts == nil {
+		opts = &EncodeOptions{}
+	}
+	if len(data.frames) == 0 {
+		return fmt.Errorf("No frames to write")
+	}
+	image, a, err := spriteSheet(data, sheet, opts)
+	if err != nil {
+		return err
+	}
+	if err := WritePngWithOptions(w, image, opts); err != nil {
+		return err
+	}
+	e := json.NewEncoder(atlas)
+	e.SetIndent("", "  ")
+	return e.Encode(a)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestSpriteSheet(t *testing.T) {
+	for _, layout := range []SheetLayout{SheetGrid, SheetPacked} {
+		for _, c := range corpus {
+			t.Run(layout.String()+"/"+c.name, func(t *testing.T) {
+				data, err := ReadGif(bytes.NewReader(c.gif()), false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var out, atlasOut bytes.Buffer
+				sheet := &SheetOptions{Layout: layout, Padding: 1}
+				if err := WriteSpriteSheet(&out, &atlasOut, data, sheet, nil); err != nil {
+					t.Fatal(err)
+				}
+				var atlas spriteAtlas
+				if err := json.Unmarshal(atlasOut.Bytes(), &atlas); err != nil {
+					t.Fatal(err)
+				}
+				image, err := ReadPng(&out)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(image.frames) != 1 || image.width != atlas.Meta.Size.W || image.height != atlas.Meta.Size.H {
+					t.Fatalf("sheet %dx%d with %d frames, atlas size %v", image.width, image.height, len(image.frames), atlas.Meta.Size)
+				}
+				pixels := compositeFrames(toTruecolor(image))[0]
+
+				frames := compositeFrames(toTruecolor(data))
+				if len(atlas.Frames) != len(frames) {
+					t.Fatalf("%d atlas frames, want %d", len(atlas.Frames), len(frames))
+				}
+				for i, f := range atlas.Frames {
+					if f.Duration != frames[i].delay*10 {
+						t.Errorf("frame %d: duration %d, want %d", i, f.Duration, frames[i].delay*10)
+					}
+					src, dst := f.SpriteSourceSize, f.Frame
+					// Outside the trimmed rectangle, frames must be transparent.
+					for y := 0; y < data.height; y++ {
+						for x := 0; x < data.width; x++ {
+							want := frames[i].data[(y*data.width+x)*4:][:4]
+							var got []byte
+							if x >= src.X && x < src.X+src.W && y >= src.Y && y < src.Y+src.H {
+								got = pixels.data[((dst.Y+y-src.Y)*pixels.width+dst.X+x-src.X)*4:][:4]
+							} else {
+								got = []byte{0, 0, 0, 0}
+							}
+							if !bytes.Equal(got, want) && (got[3] != 0 || want[3] != 0) {
+								t.Fatalf("frame %d at %d,%d: %v, want %v", i, x, y, got, want)
+							}
+						}
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+const centisecond = 10 * time.Millisecond
+
+// Coalesce replaces the frames with full screen frames composited as GIF viewers show them,
+// so that they can be reordered freely. Palette data is converted to RGBA first if
+// frames have local palettes or their own transparency indices, or the canvas shows
+// through without a transparency index.
+func (v *ImageData) Coalesce() {
+	if len(v.frames) == 0 {
+		return
+	}
+	if !v.truecolor && (!samePalette(v) || !sameTransparency(v) || needsClearIndex(v)) {
+		*v = *toTruecolor(v)
+	}
+	v.frames = compositeFrames(v)
+}
+
+// Reverse plays the animation backwards.
+func (v *ImageData) Reverse() {
+	v.Coalesce()
+	for i, j := 0, len(v.frames)-1; i < j; i, j = i+1, j-1 {
+		v.frames[i], v.frames[j] = v.frames[j], v.frames[i]
+	}
+}
+
+// PingPong plays the animation forwards and then backwards.
+// The first and last frames are not repeated at the turns.
+func (v *ImageData) PingPong() {
+	v.Coalesce()
+	for i := len(v.frames) - 2; i > 0; i-- {
+		v.frames = append(v.frames, v.frames[i])
+	}
+}
+
+// Trim keeps the part of the animation between start and end.
+// An end of zero means the end of the animation.
+func (v *ImageData) Trim(start, end time.Duration) error {
+	v.Coalesce()
+	s := int(start / centisecond)
+	e := math.MaxInt32
+	if end > 0 {
+		e = int(end / centisecond)
+	}
+
+	var frames []ImageFrame
+	t := 0
+	for _, f := range v.frames {
+		delay := f.delay
+		from, to := max(t, s), min(t+delay, e)
+		if to > from || (delay == 0 && t >= s && t < e) {
+			f.delay = max(to-from, 0)
+			frames = append(frames, f)
+		}
+		t += delay
+	}
+	if len(frames) == 0 {
+		return errors.New("No frames in the trimmed range")
+	}
+	v.frames = frames
+	return nil
+}
+
+// ChangeSpeed divides every frame delay by factor. Unlike EncodeOptions.Speed,
+// it changes the data itself, so it applies to every output format.
+func (v *ImageData) ChangeSpeed(factor float64) error {
+	if factor <= 0 {
+		return errors.New("Speed factor must be positive")
+	}
+	for i := range v.frames {
+		v.frames[i].delay = int(math.Round(float64(v.frames[i].delay) / factor))
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+	"math"
+)
+
+// VerifyError reports the first difference found by VerifyPng.
+// X and Y are -1 if the difference is not in a pixel.
+type VerifyError struct {
+	Frame int
+	X, Y  int
+	Msg   string
+}
+
+func (e *VerifyError) Error() string {
+	if e.X < 0 {
+		return fmt.Sprintf("Verify failed at frame %d: %s", e.Frame, e.Msg)
+	}
+	return fmt.Sprintf("Verify failed at frame %d, pixel (%d, %d): %s", e.Frame, e.X, e.Y, e.Msg)
+}
+
+// ReadGifReference decodes a GIF with image/gif, independently of ReadGif, and
+// composites it as browsers do: frames are drawn over a transparent canvas and
+// disposing to background clears to transparent. The result holds one RGBA
+// frame per GIF frame.
+func ReadGifReference(r io.Reader) (*ImageData, error) {
+	g, err := gif.DecodeAll(r)
+	if err != nil {
+		return nil, err
+	}
+	data := &ImageData{
+		width:             g.Config.Width,
+		height:            g.Config.Height,
+		transparencyIndex: -1,
+		truecolor:         true,
+	}
+	// image/gif counts repetitions, with -1 for none.
+	switch g.LoopCount {
+	case -1:
+		data.loopCount = 1
+	case 0:
+		data.loopCount = 0
+	default:
+		data.loopCount = g.LoopCount + 1
+	}
+	canvas := image.NewNRGBA(image.Rect(0, 0, data.width, data.height))
+	for i, m := range g.Image {
+		var saved []byte
+		if g.Disposal[i] == gif.DisposalPrevious {
+			saved = append([]byte(nil), canvas.Pix...)
+		}
+		draw.Draw(canvas, m.Bounds(), m, m.Bounds().Min, draw.Over)
+		data.frames = append(data.frames, ImageFrame{
+			width:             data.width,
+			height:            data.height,
+			delay:             g.Delay[i],
+			disposal:          disposalBackground,
+			transparencyIndex: -1,
+			data:              append([]byte(nil), canvas.Pix...),
+		})
+		switch g.Disposal[i] {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, m.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			copy(canvas.Pix, saved)
+		}
+	}
+	return data, nil
+}
+
+// rgbaFrame returns the pixels of a frame of data as RGBA.
+func rgbaFrame(data *ImageData, frame *ImageFrame) []byte {
+	if data.truecolor {
+		return frame.data
+	}
+	p := frame.palette
+	if p == nil {
+		p = data.palette
+	}
+	rgba := make([]byte, len(frame.data)*4)
+	for i, c := range frame.data {
+		if int(c) == frame.transparencyIndex || int(c) >= len(p) {
+			continue
+		}
+		rgba[i*4], rgba[i*4+1], rgba[i*4+2], rgba[i*4+3] = p[c].r, p[c].g, p[c].b, 255
+	}
+	return rgba
+}
+
+// firstDifference returns the index of the first pixel which differs.
+// Transparent pixels are equal whatever their color.
+func firstDifference(a, b []byte) int {
+	for i := 0; i+3 < len(a); i += 4 {
+		if a[i+3] == 0 && b[i+3] == 0 {
+			continue
+		}
+		if !bytes.Equal(a[i:i+4], b[i:i+4]) {
+			return i / 4
+		}
+	}
+	return -1
+}
+
+// VerifyPng decodes a PNG or APNG written by WritePngWithOptions with opts and
+// compares each composited frame and its delay with want, which is usually made
+// by ReadGifReference. The first mismatch is reported as *VerifyError.
+func VerifyPng(r io.Reader, want *ImageData, opts *EncodeOptions) error {
+	if opts == nil {
+		opts = &EncodeOptions{}
+	}
+	got, err := ReadPng(r)
+	if err != nil {
+		return err
+	}
+	if got.width != want.width || got.height != want.height {
+		return &VerifyError{X: -1, Y: -1, Msg: fmt.Sprintf("Size mismatch. expected: %dx%d, actual: %dx%d", want.width, want.height, got.width, got.height)}
+	}
+
+	expected := compositeFrames(want)
+	if opts.MergeDuplicateFrames {
+		expected = mergeDuplicateFrames(expected)
+	}
+	actual := compositeFrames(got)
+	if len(actual) != len(expected) {
+		return &VerifyError{X: -1, Y: -1, Msg: fmt.Sprintf("Frame count mismatch. expected: %d, actual: %d", len(expected), len(actual))}
+	}
+	if len(expected) > 1 && got.loopCount != want.loopCount {
+		return &VerifyError{X: -1, Y: -1, Msg: fmt.Sprintf("Loop count mismatch. expected: %d, actual: %d", want.loopCount, got.loopCount)}
+	}
+	for i := range expected {
+		e, a := rgbaFrame(want, &expected[i]), rgbaFrame(got, &actual[i])
+		if p := firstDifference(e, a); p != -1 {
+			return &VerifyError{Frame: i, X: p % want.width, Y: p / want.width,
+				Msg: fmt.Sprintf("expected: %v, actual: %v", e[p*4:p*4+4], a[p*4:p*4+4])}
+		}
+		if len(expected) == 1 {
+			break
+		}
+		num, den := opts.frameDelay(expected[i].delay)
+		if den == 0 {
+			den = 100
+		}
+		delay := int(math.Round(float64(num) * 100 / float64(den)))
+		if actual[i].delay != delay {
+			return &VerifyError{Frame: i, X: -1, Y: -1, Msg: fmt.Sprintf("Delay mismatch. expected: %d, actual: %d", delay, actual[i].delay)}
+		}
+	}
+	return nil
+}
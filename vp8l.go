@@ -0,0 +1,525 @@
+package main
+
+import (
+	"math/bits"
+	"sort"
+)
+
+const (
+	vp8lSignature = 0x2f
+	vp8lMaxSize   = 16384
+
+	vp8lSubtractGreen = 2
+	vp8lColorIndexing = 3
+
+	vp8lLengthCodes   = 24
+	vp8lDistanceCodes = 40
+	vp8lMinMatch      = 3
+	vp8lMaxLength     = 4096
+	vp8lMaxDistance   = 1<<20 - 120
+)
+
+// vp8lCodeLengthOrder is the order in which the code length code lengths are written.
+var vp8lCodeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// vp8lDistanceMap holds the (x, y) offsets of the distance codes 1 to 120,
+// which are cheaper than plain distances for pixels close in two dimensions.
+var vp8lDistanceMap = [120][2]int{
+	{0, 1}, {1, 0}, {1, 1}, {-1, 1}, {0, 2}, {2, 0}, {1, 2}, {-1, 2},
+	{2, 1}, {-2, 1}, {2, 2}, {-2, 2}, {0, 3}, {3, 0}, {1, 3}, {-1, 3},
+	{3, 1}, {-3, 1}, {2, 3}, {-2, 3}, {3, 2}, {-3, 2}, {0, 4}, {4, 0},
+	{1, 4}, {-1, 4}, {4, 1}, {-4, 1}, {3, 3}, {-3, 3}, {2, 4}, {-2, 4},
+	{4, 2}, {-4, 2}, {0, 5}, {3, 4}, {-3, 4}, {4, 3}, {-4, 3}, {5, 0},
+	{1, 5}, {-1, 5}, {5, 1}, {-5, 1}, {2, 5}, {-2, 5}, {5, 2}, {-5, 2},
+	{4, 4}, {-4, 4}, {3, 5}, {-3, 5}, {5, 3}, {-5, 3}, {0, 6}, {6, 0},
+	{1, 6}, {-1, 6}, {6, 1}, {-6, 1}, {2, 6}, {-2, 6}, {6, 2}, {-6, 2},
+	{4, 5}, {-4, 5}, {5, 4}, {-5, 4}, {3, 6}, {-3, 6}, {6, 3}, {-6, 3},
+	{0, 7}, {7, 0}, {1, 7}, {-1, 7}, {5, 5}, {-5, 5}, {7, 1}, {-7, 1},
+	{4, 6}, {-4, 6}, {6, 4}, {-6, 4}, {2, 7}, {-2, 7}, {7, 2}, {-7, 2},
+	{3, 7}, {-3, 7}, {7, 3}, {-7, 3}, {5, 6}, {-5, 6}, {6, 5}, {-6, 5},
+	{8, 0}, {4, 7}, {-4, 7}, {7, 4}, {-7, 4}, {8, 1}, {8, 2}, {6, 6},
+	{-6, 6}, {8, 3}, {5, 7}, {-5, 7}, {7, 5}, {-7, 5}, {8, 4}, {6, 7},
+	{-6, 7}, {7, 6}, {-7, 6}, {8, 5}, {7, 7}, {-7, 7}, {8, 6}, {8, 7},
+}
+
+// bitWriter packs values starting from the least significant bit, as VP8L reads them.
+type bitWriter struct {
+	buf  []byte
+	acc  uint64
+	nacc uint
+}
+
+func (v *bitWriter) writeBits(value uint32, n uint) {
+	v.acc |= uint64(value) << v.nacc
+	v.nacc += n
+	for v.nacc >= 8 {
+		v.buf = append(v.buf, byte(v.acc))
+		v.acc >>= 8
+		v.nacc -= 8
+	}
+}
+
+func (v *bitWriter) bytes() []byte {
+	if v.nacc > 0 {
+		v.buf = append(v.buf, byte(v.acc))
+		v.acc, v.nacc = 0, 0
+	}
+	return v.buf
+}
+
+// huffmanLengths returns the code length of every symbol of a Huffman code for
+// counts, limited to maxLength bits. Unused symbols get length 0.
+func huffmanLengths(counts []int, maxLength int) []byte {
+	lengths := make([]byte, len(counts))
+	var symbols []int
+	for s, c := range counts {
+		if c > 0 {
+			symbols = append(symbols, s)
+		}
+	}
+	if len(symbols) == 1 {
+		lengths[symbols[0]] = 1
+	}
+	if len(symbols) < 2 {
+		return lengths
+	}
+
+	weights := make([]int, len(counts))
+	copy(weights, counts)
+	for {
+		sort.SliceStable(symbols, func(i, j int) bool { return weights[symbols[i]] < weights[symbols[j]] })
+
+		// Leaves come first, sorted by weight, and the merged nodes follow in the
+		// order they are made, which is sorted by weight too.
+		n := len(symbols)
+		weight := make([]int, n, 2*n-1)
+		for i, s := range symbols {
+			weight[i] = weights[s]
+		}
+		parent := make([]int, 2*n-1)
+		leaf, inner := 0, n
+		next := func() int {
+			if leaf < n && (inner == len(weight) || weight[leaf] <= weight[inner]) {
+				leaf++
+				return leaf - 1
+			}
+			inner++
+			return inner - 1
+		}
+		for len(weight) < 2*n-1 {
+			a, b := next(), next()
+			parent[a], parent[b] = len(weight), len(weight)
+			weight = append(weight, weight[a]+weight[b])
+		}
+
+		depth := make([]int, 2*n-1)
+		longest := 0
+		for i := 2*n - 3; i >= 0; i-- {
+			depth[i] = depth[parent[i]] + 1
+			longest = max(longest, depth[i])
+		}
+		if longest <= maxLength {
+			for i, s := range symbols {
+				lengths[s] = byte(depth[i])
+			}
+			return lengths
+		}
+		// Flatten the distribution until the tree is shallow enough.
+		for _, s := range symbols {
+			weights[s] = max(weights[s]/2, 1)
+		}
+	}
+}
+
+// prefixCode is a canonical Huffman code. The codes are bit-reversed, so that
+// they are written LSB first. A code of one symbol is written with zero bits.
+type prefixCode struct {
+	lengths []byte
+	codes   []uint16
+	symbols int
+}
+
+func newPrefixCode(counts []int, maxLength int) *prefixCode {
+	v := &prefixCode{lengths: huffmanLengths(counts, maxLength), codes: make([]uint16, len(counts))}
+	var count [16]int
+	for _, l := range v.lengths {
+		if l > 0 {
+			count[l]++
+			v.symbols++
+		}
+	}
+	var next [16]int
+	code := 0
+	for l := 1; l < 16; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+	for s, l := range v.lengths {
+		if l > 0 {
+			v.codes[s] = bits.Reverse16(uint16(next[l])) >> (16 - l)
+			next[l]++
+		}
+	}
+	return v
+}
+
+func (v *prefixCode) write(w *bitWriter, symbol int) {
+	if v.symbols > 1 {
+		w.writeBits(uint32(v.codes[symbol]), uint(v.lengths[symbol]))
+	}
+}
+
+// codeLength is a symbol of the code length code with its extra bits.
+type codeLength struct {
+	symbol    int
+	extra     uint32
+	extraBits uint
+}
+
+// codeLengthSymbols run-length encodes code lengths: 16 repeats the previous
+// non-zero length 3 to 6 times, 17 and 18 write 3 to 10 and 11 to 138 zeros.
+func codeLengthSymbols(lengths []byte) []codeLength {
+	var symbols []codeLength
+	prev := byte(8)
+	for i := 0; i < len(lengths); {
+		l := lengths[i]
+		run := 1
+		for i+run < len(lengths) && lengths[i+run] == l {
+			run++
+		}
+		i += run
+		if l == 0 {
+			for run >= 11 {
+				n := min(run, 138)
+				symbols = append(symbols, codeLength{18, uint32(n - 11), 7})
+				run -= n
+			}
+			if run >= 3 {
+				symbols = append(symbols, codeLength{17, uint32(run - 3), 3})
+				run = 0
+			}
+		} else {
+			if l != prev {
+				symbols = append(symbols, codeLength{symbol: int(l)})
+				run--
+				prev = l
+			}
+			for run >= 3 {
+				n := min(run, 6)
+				symbols = append(symbols, codeLength{16, uint32(n - 3), 2})
+				run -= n
+			}
+		}
+		for ; run > 0; run-- {
+			symbols = append(symbols, codeLength{symbol: int(l)})
+		}
+	}
+	return symbols
+}
+
+// writePrefixCode writes code for an alphabet of len(code.lengths) symbols.
+// Codes of up to two symbols below 256 use the simple form.
+func writePrefixCode(w *bitWriter, code *prefixCode) {
+	var used []int
+	for s, l := range code.lengths {
+		if l > 0 {
+			used = append(used, s)
+		}
+	}
+	if len(used) == 0 {
+		used = []int{0}
+	}
+	if len(used) <= 2 && used[len(used)-1] < 256 {
+		w.writeBits(1, 1)
+		w.writeBits(uint32(len(used)-1), 1)
+		if used[0] < 2 {
+			w.writeBits(0, 1)
+			w.writeBits(uint32(used[0]), 1)
+		} else {
+			w.writeBits(1, 1)
+			w.writeBits(uint32(used[0]), 8)
+		}
+		if len(used) == 2 {
+			w.writeBits(uint32(used[1]), 8)
+		}
+		return
+	}
+
+	symbols := codeLengthSymbols(code.lengths)
+	counts := make([]int, len(vp8lCodeLengthOrder))
+	for _, s := range symbols {
+		counts[s.symbol]++
+	}
+	lengthCode := newPrefixCode(counts, 7)
+	n := len(vp8lCodeLengthOrder)
+	for n > 4 && lengthCode.lengths[vp8lCodeLengthOrder[n-1]] == 0 {
+		n--
+	}
+	w.writeBits(0, 1)
+	w.writeBits(uint32(n-4), 4)
+	for _, s := range vp8lCodeLengthOrder[:n] {
+		w.writeBits(uint32(lengthCode.lengths[s]), 3)
+	}
+	// Every symbol of the alphabet has a code length.
+	w.writeBits(0, 1)
+	for _, s := range symbols {
+		lengthCode.write(w, s.symbol)
+		w.writeBits(s.extra, s.extraBits)
+	}
+}
+
+// prefixEncode splits a length or distance code into a prefix symbol and extra bits.
+func prefixEncode(value int) (prefix int, extraBits uint, extra uint32) {
+	d := value - 1
+	if d < 4 {
+		return d, 0, 0
+	}
+	high := bits.Len(uint(d)) - 1
+	second := d >> (high - 1) & 1
+	extraBits = uint(high - 1)
+	return 2*high + second, extraBits, uint32(d) & (1<<extraBits - 1)
+}
+
+// backRef is a literal pixel if length is zero, and a copy of length pixels
+// from distance pixels back otherwise.
+type backRef struct {
+	argb     uint32
+	length   int
+	distance int
+}
+
+func matchLength(pixels []uint32, from, to, limit int) int {
+	n := 0
+	for n < limit && pixels[from+n] == pixels[to+n] {
+		n++
+	}
+	return n
+}
+
+// findBackRefs greedily replaces runs of pixels seen before with copies,
+// following hash chains of pixel pairs.
+func findBackRefs(pixels []uint32) []backRef {
+	const (
+		hashBits = 16
+		maxChain = 64
+	)
+	head := make([]int32, 1<<hashBits)
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int32, len(pixels))
+	hash := func(i int) uint32 {
+		return (pixels[i]*0x1e35a7bd ^ pixels[i+1]*0x9e3779b1) >> (32 - hashBits)
+	}
+	insert := func(i int) {
+		if i+1 < len(pixels) {
+			h := hash(i)
+			prev[i] = head[h]
+			head[h] = int32(i)
+		}
+	}
+
+	var refs []backRef
+	for i := 0; i < len(pixels); {
+		best, bestDistance := 0, 0
+		if i+1 < len(pixels) {
+			limit := min(vp8lMaxLength, len(pixels)-i)
+			for j, chain := head[hash(i)], 0; j >= 0 && chain < maxChain && i-int(j) <= vp8lMaxDistance; j, chain = prev[j], chain+1 {
+				if n := matchLength(pixels, int(j), i, limit); n > best {
+					best, bestDistance = n, i-int(j)
+					if n == limit {
+						break
+					}
+				}
+			}
+		}
+		if best < vp8lMinMatch {
+			refs = append(refs, backRef{argb: pixels[i]})
+			insert(i)
+			i++
+			continue
+		}
+		refs = append(refs, backRef{length: best, distance: bestDistance})
+		for k := 0; k < best; k++ {
+			insert(i + k)
+		}
+		i += best
+	}
+	return refs
+}
+
+// distanceCodes maps the distances of the offsets in vp8lDistanceMap to their
+// distance codes for an image of width pixels.
+func distanceCodes(width int) map[int]int {
+	codes := make(map[int]int)
+	for i := len(vp8lDistanceMap) - 1; i >= 0; i-- {
+		d := vp8lDistanceMap[i][0] + vp8lDistanceMap[i][1]*width
+		codes[max(d, 1)] = i + 1
+	}
+	return codes
+}
+
+// writeEntropyImage writes the prefix codes and the LZ77 coded pixels of an
+// image without color cache. Only the main image has the meta prefix code bit.
+func writeEntropyImage(w *bitWriter, pixels []uint32, width int, main bool) {
+	w.writeBits(0, 1)
+	if main {
+		w.writeBits(0, 1)
+	}
+
+	refs := findBackRefs(pixels)
+	planar := distanceCodes(width)
+	green := make([]int, 256+vp8lLengthCodes)
+	red := make([]int, 256)
+	blue := make([]int, 256)
+	alpha := make([]int, 256)
+	distance := make([]int, vp8lDistanceCodes)
+	for i, r := range refs {
+		if r.length == 0 {
+			green[r.argb>>8&0xff]++
+			red[r.argb>>16&0xff]++
+			blue[r.argb&0xff]++
+			alpha[r.argb>>24]++
+			continue
+		}
+		if code, ok := planar[r.distance]; ok {
+			refs[i].distance = code
+		} else {
+			refs[i].distance = r.distance + len(vp8lDistanceMap)
+		}
+		p, _, _ := prefixEncode(r.length)
+		green[256+p]++
+		p, _, _ = prefixEncode(refs[i].distance)
+		distance[p]++
+	}
+
+	codes := []*prefixCode{
+		newPrefixCode(green, 15),
+		newPrefixCode(red, 15),
+		newPrefixCode(blue, 15),
+		newPrefixCode(alpha, 15),
+		newPrefixCode(distance, 15),
+	}
+	for _, c := range codes {
+		writePrefixCode(w, c)
+	}
+	for _, r := range refs {
+		if r.length == 0 {
+			codes[0].write(w, int(r.argb>>8&0xff))
+			codes[1].write(w, int(r.argb>>16&0xff))
+			codes[2].write(w, int(r.argb&0xff))
+			codes[3].write(w, int(r.argb>>24))
+			continue
+		}
+		p, n, extra := prefixEncode(r.length)
+		codes[0].write(w, 256+p)
+		w.writeBits(extra, n)
+		p, n, extra = prefixEncode(r.distance)
+		codes[4].write(w, p)
+		w.writeBits(extra, n)
+	}
+}
+
+// subPixels subtracts b from a per channel.
+func subPixels(a, b uint32) uint32 {
+	alphaAndGreen := 0x00ff00ff + a&0xff00ff00 - b&0xff00ff00
+	redAndBlue := 0xff00ff00 + a&0x00ff00ff - b&0x00ff00ff
+	return alphaAndGreen&0xff00ff00 | redAndBlue&0x00ff00ff
+}
+
+// distinctColors returns the sorted colors of pixels if there are at most 256.
+func distinctColors(pixels []uint32) ([]uint32, bool) {
+	seen := make(map[uint32]bool)
+	var table []uint32
+	for _, p := range pixels {
+		if !seen[p] {
+			if len(table) == 256 {
+				return nil, false
+			}
+			seen[p] = true
+			table = append(table, p)
+		}
+	}
+	sort.Slice(table, func(i, j int) bool { return table[i] < table[j] })
+	return table, true
+}
+
+// bundlePixels replaces pixels with their indices in table, packing 2, 4 or 8
+// indices into the green channel of one pixel for small tables.
+// It returns the packed pixels and their width.
+func bundlePixels(pixels []uint32, width, height int, table []uint32) ([]uint32, int) {
+	index := make(map[uint32]uint32, len(table))
+	for i, c := range table {
+		index[c] = uint32(i)
+	}
+	widthBits := 0
+	switch {
+	case len(table) <= 2:
+		widthBits = 3
+	case len(table) <= 4:
+		widthBits = 2
+	case len(table) <= 16:
+		widthBits = 1
+	}
+	packedWidth := (width + 1<<widthBits - 1) >> widthBits
+	bitsPerPixel := 8 >> widthBits
+	packed := make([]uint32, packedWidth*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			shift := bitsPerPixel*(x&(1<<widthBits-1)) + 8
+			packed[y*packedWidth+x>>widthBits] |= index[pixels[y*width+x]] << shift
+		}
+	}
+	for i := range packed {
+		packed[i] |= 0xff000000
+	}
+	return packed, packedWidth
+}
+
+// encodeVP8L encodes RGBA pixels as a VP8L lossless bitstream. Images of at
+// most 256 colors use the color indexing transform, others subtract green.
+// Transparent pixels are stored as transparent black.
+func encodeVP8L(rgba []byte, width, height int) []byte {
+	pixels := make([]uint32, width*height)
+	alphaUsed := false
+	for i := range pixels {
+		p := rgba[i*4 : i*4+4]
+		if p[3] != 0 {
+			pixels[i] = uint32(p[3])<<24 | uint32(p[0])<<16 | uint32(p[1])<<8 | uint32(p[2])
+		}
+		alphaUsed = alphaUsed || p[3] != 255
+	}
+
+	w := &bitWriter{}
+	w.writeBits(vp8lSignature, 8)
+	w.writeBits(uint32(width-1), 14)
+	w.writeBits(uint32(height-1), 14)
+	if alphaUsed {
+		w.writeBits(1, 1)
+	} else {
+		w.writeBits(0, 1)
+	}
+	w.writeBits(0, 3)
+
+	w.writeBits(1, 1)
+	if table, ok := distinctColors(pixels); ok {
+		w.writeBits(vp8lColorIndexing, 2)
+		w.writeBits(uint32(len(table)-1), 8)
+		delta := make([]uint32, len(table))
+		delta[0] = table[0]
+		for i := 1; i < len(table); i++ {
+			delta[i] = subPixels(table[i], table[i-1])
+		}
+		writeEntropyImage(w, delta, len(delta), false)
+		pixels, width = bundlePixels(pixels, width, height, table)
+	} else {
+		w.writeBits(vp8lSubtractGreen, 2)
+		for i, p := range pixels {
+			g := p >> 8 & 0xff
+			pixels[i] = subPixels(p, g<<16|g)
+		}
+	}
+	w.writeBits(0, 1)
+	writeEntropyImage(w, pixels, width, true)
+	return w.bytes()
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// bitReader reads values starting from the least significant bit. Reading past
+// the end sets err and returns zeros.
+type bitReader struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func (r *bitReader) read(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if r.pos>>3 >= len(r.b) {
+			r.err = fmt.Errorf("Unexpected end of data")
+			return 0
+		}
+		v |= uint32(r.b[r.pos>>3]>>(r.pos&7)&1) << i
+		r.pos++
+	}
+	return v
+}
+
+// huffmanDecoder decodes a canonical code from its code lengths.
+type huffmanDecoder struct {
+	symbols map[uint32]int
+	single  int
+}
+
+func newHuffmanDecoder(lengths []byte) (*huffmanDecoder, error) {
+	var count [16]int
+	used, last := 0, 0
+	for s, l := range lengths {
+		if l > 0 {
+			count[l]++
+			used, last = used+1, s
+		}
+	}
+	if used == 0 {
+		return nil, fmt.Errorf("Empty prefix code")
+	}
+	if used == 1 {
+		return &huffmanDecoder{single: last}, nil
+	}
+	var next [16]int
+	code := 0
+	for l := 1; l < 16; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+	v := &huffmanDecoder{symbols: make(map[uint32]int), single: -1}
+	for s, l := range lengths {
+		if l > 0 {
+			v.symbols[uint32(l)<<16|uint32(next[l])] = s
+			next[l]++
+		}
+	}
+	return v, nil
+}
+
+func (v *huffmanDecoder) decode(r *bitReader) (int, error) {
+	if v.single >= 0 {
+		return v.single, nil
+	}
+	code := uint32(0)
+	for l := uint32(1); l < 16; l++ {
+		code = code<<1 | r.read(1)
+		if s, ok := v.symbols[l<<16|code]; ok {
+			return s, r.err
+		}
+	}
+	return 0, fmt.Errorf("Invalid prefix code at bit %d", r.pos)
+}
+
+func readPrefixCode(r *bitReader, alphabet int) (*huffmanDecoder, error) {
+	lengths := make([]byte, alphabet)
+	if r.read(1) == 1 {
+		n := r.read(1) + 1
+		first := r.read(1 + 7*int(r.read(1)))
+		lengths[first] = 1
+		if n == 2 {
+			lengths[r.read(8)] = 1
+		}
+		return newHuffmanDecoder(lengths)
+	}
+
+	lengthLengths := make([]byte, len(vp8lCodeLengthOrder))
+	n := int(r.read(4)) + 4
+	for _, s := range vp8lCodeLengthOrder[:n] {
+		lengthLengths[s] = byte(r.read(3))
+	}
+	lengthCode, err := newHuffmanDecoder(lengthLengths)
+	if err != nil {
+		return nil, err
+	}
+	if r.read(1) == 1 {
+		return nil, fmt.Errorf("max_symbol is not supported")
+	}
+	prev := byte(8)
+	for i := 0; i < alphabet; {
+		s, err := lengthCode.decode(r)
+		if err != nil {
+			return nil, err
+		}
+		repeat, value := 1, byte(s)
+		switch s {
+		case 16:
+			repeat, value = 3+int(r.read(2)), prev
+		case 17:
+			repeat, value = 3+int(r.read(3)), 0
+		case 18:
+			repeat, value = 11+int(r.read(7)), 0
+		default:
+			if s != 0 {
+				prev = value
+			}
+		}
+		if i+repeat > alphabet {
+			return nil, fmt.Errorf("Too many code lengths")
+		}
+		for ; repeat > 0; repeat-- {
+			lengths[i] = value
+			i++
+		}
+	}
+	return newHuffmanDecoder(lengths)
+}
+
+// prefixValue reads the extra bits of a length or distance prefix symbol.
+func prefixValue(r *bitReader, prefix int) int {
+	if prefix < 4 {
+		return prefix + 1
+	}
+	extraBits := (prefix - 2) >> 1
+	offset := (2 + prefix&1) << extraBits
+	return offset + int(r.read(extraBits)) + 1
+}
+
+// readEntropyImage reads an LZ77 coded image without color cache or meta prefix codes.
+func readEntropyImage(r *bitReader, width, height int, main bool) ([]uint32, error) {
+	if r.read(1) == 1 {
+		return nil, fmt.Errorf("Color cache is not supported")
+	}
+	if main && r.read(1) == 1 {
+		return nil, fmt.Errorf("Meta prefix codes are not supported")
+	}
+	var codes [5]*huffmanDecoder
+	for i, alphabet := range []int{256 + vp8lLengthCodes, 256, 256, 256, vp8lDistanceCodes} {
+		c, err := readPrefixCode(r, alphabet)
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = c
+	}
+
+	pixels := make([]uint32, width*height)
+	for i := 0; i < len(pixels); {
+		g, err := codes[0].decode(r)
+		if err != nil {
+			return nil, err
+		}
+		if g < 256 {
+			var argb [3]int
+			for j := range argb {
+				if argb[j], err = codes[j+1].decode(r); err != nil {
+					return nil, err
+				}
+			}
+			pixels[i] = uint32(argb[2])<<24 | uint32(argb[0])<<16 | uint32(g)<<8 | uint32(argb[1])
+			i++
+			continue
+		}
+		length := prefixValue(r, g-256)
+		d, err := codes[4].decode(r)
+		if err != nil {
+			return nil, err
+		}
+		distance := prefixValue(r, d)
+		if distance > len(vp8lDistanceMap) {
+			distance -= len(vp8lDistanceMap)
+		} else {
+			offset := vp8lDistanceMap[distance-1]
+			distance = max(offset[0]+offset[1]*width, 1)
+		}
+		if distance > i || i+length > len(pixels) {
+			return nil, fmt.Errorf("Invalid copy of %d pixels from %d back at pixel %d", length, distance, i)
+		}
+		for ; length > 0; length-- {
+			pixels[i] = pixels[i-distance]
+			i++
+		}
+	}
+	return pixels, r.err
+}
+
+func addPixels(a, b uint32) uint32 {
+	alphaAndGreen := a&0xff00ff00 + b&0xff00ff00
+	redAndBlue := a&0x00ff00ff + b&0x00ff00ff
+	return alphaAndGreen&0xff00ff00 | redAndBlue&0x00ff00ff
+}
+
+// decodeVP8L decodes the subset of VP8L which encodeVP8L writes into ARGB pixels.
+func decodeVP8L(b []byte) ([]uint32, int, int, error) {
+	r := &bitReader{b: b}
+	if r.read(8) != vp8lSignature {
+		return nil, 0, 0, fmt.Errorf("Bad signature")
+	}
+	width, height := int(r.read(14))+1, int(r.read(14))+1
+	r.read(1)
+	if r.read(3) != 0 {
+		return nil, 0, 0, fmt.Errorf("Bad version")
+	}
+
+	var palette []uint32
+	subtractGreen := false
+	packedWidth, widthBits := width, 0
+	for r.read(1) == 1 {
+		switch t := r.read(2); t {
+		case vp8lSubtractGreen:
+			subtractGreen = true
+		case vp8lColorIndexing:
+			size := int(r.read(8)) + 1
+			delta, err := readEntropyImage(r, size, 1, false)
+			if err != nil {
+				return nil, 0, 0, err
+			}
+			palette = delta
+			for i := 1; i < size; i++ {
+				palette[i] = addPixels(palette[i], palette[i-1])
+			}
+			switch {
+			case size <= 2:
+				widthBits = 3
+			case size <= 4:
+				widthBits = 2
+			case size <= 16:
+				widthBits = 1
+			}
+			packedWidth = (width + 1<<widthBits - 1) >> widthBits
+		default:
+			return nil, 0, 0, fmt.Errorf("Transform %d is not supported", t)
+		}
+	}
+	if r.err != nil {
+		return nil, 0, 0, r.err
+	}
+
+	packed, err := readEntropyImage(r, packedWidth, height, true)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	pixels := packed
+	if palette != nil {
+		pixels = make([]uint32, width*height)
+		bitsPerPixel := 8 >> widthBits
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				shift := bitsPerPixel*(x&(1<<widthBits-1)) + 8
+				index := int(packed[y*packedWidth+x>>widthBits] >> shift & (1<<bitsPerPixel - 1))
+				if index < len(palette) {
+					pixels[y*width+x] = palette[index]
+				}
+			}
+		}
+	}
+	if subtractGreen {
+		for i, p := range pixels {
+			g := p >> 8 & 0xff
+			pixels[i] = addPixels(p, g<<16|g)
+		}
+	}
+	return pixels, width, height, nil
+}
+
+// checkVP8L decodes the encoding of rgba and compares the pixels. Transparent
+// pixels must come back as transparent black.
+func checkVP8L(t *testing.T, name string, encoded, rgba []byte, width, height int) {
+	t.Helper()
+	pixels, w, h, err := decodeVP8L(encoded)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	if w != width || h != height {
+		t.Fatalf("%s: decoded %dx%d, want %dx%d", name, w, h, width, height)
+	}
+	for i, p := range pixels {
+		c := rgba[i*4 : i*4+4]
+		want := uint32(0)
+		if c[3] != 0 {
+			want = uint32(c[3])<<24 | uint32(c[0])<<16 | uint32(c[1])<<8 | uint32(c[2])
+		}
+		if p != want {
+			t.Fatalf("%s: pixel %d, %d is %08x, want %08x", name, i%width, i/width, p, want)
+		}
+	}
+}
+
+func TestVP8LRoundTrip(t *testing.T) {
+	for _, c := range corpus {
+		data, err := ReadGif(bytes.NewReader(c.gif()), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames := compositeFrames(toTruecolor(data))
+		for i, f := range frames {
+			name := fmt.Sprintf("%s frame %d", c.name, i)
+			checkVP8L(t, name, encodeVP8L(f.data, f.width, f.height), f.data, f.width, f.height)
+		}
+
+		if len(frames) == 1 {
+			var out bytes.Buffer
+			if err := WriteWebp(&out, data); err != nil {
+				t.Fatal(err)
+			}
+			chunks := readWebpChunks(t, out.Bytes()[12:])
+			checkVP8L(t, c.name+" still", chunks[0].payload, frames[0].data, data.width, data.height)
+		}
+	}
+
+	// Palettes of every bundling width, and enough colors to subtract green.
+	rnd := rand.New(rand.NewSource(1))
+	for _, colors := range []int{1, 2, 3, 4, 5, 16, 17, 256, 1000} {
+		for _, width := range []int{1, 7, 33} {
+			height := 9
+			palette := make([][4]byte, colors)
+			for i := range palette {
+				binary.LittleEndian.PutUint32(palette[i][:], rnd.Uint32())
+				if i%3 == 0 {
+					palette[i][3] = 255
+				}
+			}
+			rgba := make([]byte, width*height*4)
+			for i := 0; i < width*height; i++ {
+				// Runs of one color give the encoder something to copy.
+				p := palette[(i/5*7)%colors]
+				if rnd.Intn(4) == 0 {
+					p = palette[rnd.Intn(colors)]
+				}
+				copy(rgba[i*4:], p[:])
+			}
+			name := fmt.Sprintf("%d colors %dx%d", colors, width, height)
+			checkVP8L(t, name, encodeVP8L(rgba, width, height), rgba, width, height)
+		}
+	}
+}
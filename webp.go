@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"sync"
+)
+
+const (
+	vp8xAnimation = 0x02
+	vp8xAlpha     = 0x10
+
+	anmfDispose = 0x01
+	anmfNoBlend = 0x02
+)
+
+// webpFrame is a frame as written to ANMF. RGBA pixels only.
+type webpFrame struct {
+	ImageFrame
+	dispose bool
+	blend   bool
+}
+
+func appendUint24(b []byte, v int) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16))
+}
+
+func appendWebpChunk(b []byte, fourCC string, payload []byte) []byte {
+	b = append(b, fourCC...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(payload)))
+	b = append(b, payload...)
+	if len(payload)%2 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// frameDuration converts a delay in centiseconds to the ANMF duration in
+// milliseconds, applying the same timing options as frameDelay.
+func (v *EncodeOptions) frameDuration(delay int) int {
+	num, den := v.frameDelay(delay)
+	return min(int(math.Round(float64(num)*1000/float64(den))), 1<<24-1)
+}
+
+// webpMapsFrames reports whether the GIF frames can be written as they are:
+// ANMF has no dispose to previous, and its frames lie within the canvas at even offsets.
+func webpMapsFrames(data *ImageData) bool {
+	for _, f := range data.frames {
+		if f.disposal == disposalPrevious || f.xOffset%2 != 0 || f.yOffset%2 != 0 {
+			return false
+		}
+	}
+	return insideCanvas(data)
+}
+
+// optimizeWebpFrames reduces every composited frame after the first one to the
+// rectangle which differs from its predecessor, starting at even offsets.
+// Unchanged pixels become transparent where blending keeps them.
+func optimizeWebpFrames(composited []ImageFrame) []webpFrame {
+	cf := canvasFormat{4, []byte{0, 0, 0, 0}}
+	frames := make([]webpFrame, len(composited))
+	frames[0].ImageFrame = composited[0]
+	for i := 1; i < len(composited); i++ {
+		prev := &composited[i-1]
+		base := make([]int64, prev.width*prev.height)
+		for j := range base {
+			base[j] = cf.key(prev.data[j*4 : j*4+4])
+		}
+		r := changedRect(base, &composited[i], cf)
+		if r.empty() {
+			r = rect{0, 0, 1, 1}
+		}
+		r.x0 &^= 1
+		r.y0 &^= 1
+		if f, ok := cropFrame(base, &composited[i], r, blendOpOver, cf); ok {
+			frames[i] = webpFrame{ImageFrame: *f, blend: true}
+		} else {
+			f, _ := cropFrame(base, &composited[i], r, blendOpSource, cf)
+			frames[i] = webpFrame{ImageFrame: *f}
+		}
+	}
+	return frames
+}
+
+// webpFrames returns the frames to write. GIF disposal and blending map to ANMF
+// directly if possible; otherwise the frames are composited.
+func webpFrames(data *ImageData, opts *EncodeOptions) []webpFrame {
+	if len(data.frames) > 1 && !opts.OptimizeFrames && !opts.MergeDuplicateFrames && webpMapsFrames(data) {
+		frames := make([]webpFrame, len(data.frames))
+		for i, f := range data.frames {
+			frames[i] = webpFrame{
+				ImageFrame: f,
+				dispose:    f.disposal == disposalBackground,
+				blend:      !f.source,
+			}
+		}
+		return frames
+	}
+
+	composited := compositeFrames(data)
+	if opts.MergeDuplicateFrames {
+		composited = mergeDuplicateFrames(composited)
+	}
+	if opts.OptimizeFrames {
+		return optimizeWebpFrames(composited)
+	}
+	frames := make([]webpFrame, len(composited))
+	for i, f := range composited {
+		frames[i].ImageFrame = f
+	}
+	return frames
+}
+
+// encodeFrames encodes the frames as VP8L concurrently.
+func encodeFrames(frames []webpFrame, workers int) [][]byte {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	encoded := make([][]byte, len(frames))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < min(workers, len(frames)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range next {
+				f := &frames[j]
+				encoded[j] = encodeVP8L(f.data, f.width, f.height)
+			}
+		}()
+	}
+	for i := range frames {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return encoded
+}
+
+// WriteWebp writes the image data to writer in lossless WebP format.
+func WriteWebp(w io.Writer, data *ImageData) error {
+	return WriteWebpWithOptions(w, data, nil)
+}
+
+// WriteWebpWithOptions writes the image data to writer in lossless WebP format
+// as configured by opts. Animations are written with ANIM and ANMF chunks, which
+// take the loop count, delays and disposal of the GIF. Of opts, the timing
+// options, OptimizeFrames, MergeDuplicateFrames and Workers apply.
+func WriteWebpWithOptions(w io.Writer, data *ImageData, opts *EncodeOptions) error {
+	if opts == nil {
+		opts = &EncodeOptions{}
+	}
+	if len(data.frames) == 0 {
+		return fmt.Errorf("No frames to write")
+	}
+	if data.width == 0 || data.height == 0 || data.width > vp8lMaxSize || data.height > vp8lMaxSize {
+		return &UnsupportedError{Feature: fmt.Sprintf("WebP image size %dx%d", data.width, data.height)}
+	}
+	data = toTruecolor(data)
+	frames := webpFrames(data, opts)
+	encoded := encodeFrames(frames, opts.Workers)
+
+	var body []byte
+	if len(frames) == 1 {
+		body = appendWebpChunk(body, "VP8L", encoded[0])
+	} else {
+		alpha := !coversCanvas(data)
+		for _, f := range frames {
+			alpha = alpha || !opaque([]ImageFrame{f.ImageFrame})
+		}
+		vp8x := []byte{vp8xAnimation, 0, 0, 0}
+		if alpha {
+			vp8x[0] |= vp8xAlpha
+		}
+		vp8x = appendUint24(vp8x, data.width-1)
+		vp8x = appendUint24(vp8x, data.height-1)
+		body = appendWebpChunk(body, "VP8X", vp8x)
+
+		// Viewers clear the canvas to transparent black whatever the background color.
+		anim := []byte{0, 0, 0, 0}
+		anim = binary.LittleEndian.AppendUint16(anim, uint16(min(data.loopCount, math.MaxUint16)))
+		body = appendWebpChunk(body, "ANIM", anim)
+
+		for i, f := range frames {
+			anmf := appendUint24(nil, f.xOffset/2)
+			anmf = appendUint24(anmf, f.yOffset/2)
+			anmf = appendUint24(anmf, f.width-1)
+			anmf = appendUint24(anmf, f.height-1)
+			anmf = appendUint24(anmf, opts.frameDuration(f.delay))
+			var flags byte
+			if f.dispose {
+				flags |= anmfDispose
+			}
+			if !f.blend {
+				flags |= anmfNoBlend
+			}
+			anmf = append(anmf, flags)
+			anmf = appendWebpChunk(anmf, "VP8L", encoded[i])
+			body = appendWebpChunk(body, "ANMF", anmf)
+		}
+	}
+
+	header := make([]byte, 0, 12)
+	header = append(header, "RIFF"...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(4+len(body)))
+	header = append(header, "WEBP"...)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
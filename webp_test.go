@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+type webpChunk struct {
+	fourCC  string
+	payload []byte
+}
+
+func readWebpChunks(t *testing.T, b []byte) []webpChunk {
+	t.Helper()
+	var chunks []webpChunk
+	for len(b) > 0 {
+		if len(b) < 8 {
+			t.Fatalf("truncated chunk header: %d bytes", len(b))
+		}
+		n := int(binary.LittleEndian.Uint32(b[4:]))
+		if len(b) < 8+n+n%2 {
+			t.Fatalf("truncated %s chunk", b[:4])
+		}
+		chunks = append(chunks, webpChunk{string(b[:4]), b[8 : 8+n]})
+		b = b[8+n+n%2:]
+	}
+	return chunks
+}
+
+func TestWebpContainer(t *testing.T) {
+	for _, c := range corpus {
+		t.Run(c.name, func(t *testing.T) {
+			data, err := ReadGif(bytes.NewReader(c.gif()), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			if err := WriteWebp(&out, data); err != nil {
+				t.Fatal(err)
+			}
+			b := out.Bytes()
+			if string(b[:4]) != "RIFF" || string(b[8:12]) != "WEBP" || int(binary.LittleEndian.Uint32(b[4:]))+8 != len(b) {
+				t.Fatalf("bad RIFF header: % x", b[:12])
+			}
+			chunks := readWebpChunks(t, b[12:])
+
+			if len(data.frames) == 1 {
+				if len(chunks) != 1 || chunks[0].fourCC != "VP8L" || chunks[0].payload[0] != vp8lSignature {
+					t.Fatalf("still image chunks: %v", chunks)
+				}
+				return
+			}
+			if len(chunks) != 2+len(data.frames) || chunks[0].fourCC != "VP8X" || chunks[1].fourCC != "ANIM" {
+				t.Fatalf("%d chunks for %d frames", len(chunks), len(data.frames))
+			}
+			if loops := int(binary.LittleEndian.Uint16(chunks[1].payload[4:])); loops != data.loopCount {
+				t.Errorf("loop count: %d, want %d", loops, data.loopCount)
+			}
+			for i, anmf := range chunks[2:] {
+				duration := int(anmf.payload[12]) | int(anmf.payload[13])<<8 | int(anmf.payload[14])<<16
+				if duration != data.frames[i].delay*10 {
+					t.Errorf("frame %d: duration %d, want %d", i, duration, data.frames[i].delay*10)
+				}
+				frame := readWebpChunks(t, anmf.payload[16:])
+				if len(frame) != 1 || frame[0].fourCC != "VP8L" || frame[0].payload[0] != vp8lSignature {
+					t.Errorf("frame %d: bad frame data", i)
+				}
+			}
+		})
+	}
+}
+
+func TestGifLoopCount(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		want int
+	}{
+		{"still_global", 1},
+		{"local_tables", 0},
+		{"sub_rectangles", 4},
+	} {
+		for _, cc := range corpus {
+			if cc.name != c.name {
+				continue
+			}
+			data, err := ReadGif(bytes.NewReader(cc.gif()), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data.loopCount != c.want {
+				t.Errorf("%s: loop count %d, want %d", c.name, data.loopCount, c.want)
+			}
+		}
+	}
+}